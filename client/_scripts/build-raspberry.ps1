@@ -4,4 +4,5 @@
     $env:GOARCH="arm";
     $env:GOARM=7;
     $env:CGO_ENABLED="0";
-    go build -o _bin/rom-downloader
\ No newline at end of file
+    $version = git describe --tags --always --dirty
+    go build -ldflags "-X main.version=$version" -o _bin/rom-downloader
\ No newline at end of file
@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 )
 
@@ -14,13 +17,107 @@ type LoaderConfig struct {
 	SubscriptionName      string            `json:"subscriptionName"`
 	TopicName             string            `json:"topicName"`
 	ProjectID             string            `json:"projectId"`
+	DeviceID              string            `json:"deviceId"` // Identifies this client in Firestore, generated once into device-id next to the config when empty
+	HeartbeatSeconds      int               `json:"heartbeatIntervalSeconds"`
 	TempFolder            string            `json:"tempFolder"`
 	DestinationFolderRoot string            `json:"destinationFolderRoot"`
 	RomTypeDestinations   map[string]string `json:"romTypeDestinations"`
+	MessageSource         string            `json:"messageSource"`
+	DropFolder            string            `json:"dropFolder"`
+	Persistence           string            `json:"persistence"`
+	LocalStoreFile        string            `json:"localStoreFile"` // Download history kept by the local persistence
+	ExtractionLimits      ExtractionLimits  `json:"extractionLimits"`
+	OnConflict            map[string]string `json:"onConflict"` // Collision policy per ROM type, "default" applies to the rest
+	Concurrency           Concurrency       `json:"concurrency"`
+	Retry                 RetryPolicy       `json:"retry"`
+}
+
+// RetryPolicy drives the jittered exponential backoff of failed pipeline steps,
+// zero values fall back to defaults.
+type RetryPolicy struct {
+	MaxAttempts    int     `json:"maxAttempts"`
+	InitialDelayMs int     `json:"initialDelayMs"`
+	MaxDelayMs     int     `json:"maxDelayMs"`
+	Multiplier     float64 `json:"multiplier"`
+}
+
+// Concurrency sets how many workers each pipeline stage runs, zero values fall back to defaults.
+type Concurrency struct {
+	Download int `json:"download"`
+	Install  int `json:"install"`
+	Persist  int `json:"persist"`
+}
+
+// ExtractionLimits protect the SD card from archives that unpack to much more
+// than expected. Zero values fall back to defaults.
+type ExtractionLimits struct {
+	MaxTotalBytes       int64   `json:"maxTotalBytes"`
+	MaxEntries          int     `json:"maxEntries"`
+	MaxCompressionRatio float64 `json:"maxCompressionRatio"`
+	MaxFileBytes        int64   `json:"maxFileBytes"`
+	MinFreeBytes        int64   `json:"minFreeBytes"` // Space that has to stay free after extraction
 }
 
 const configFileName = "config.json"
 
+const (
+	MessageSourcePubSub     = "pubsub"
+	MessageSourceDropFolder = "dropFolder"
+)
+
+const (
+	PersistenceFirestore = "firestore"
+	PersistenceLocal     = "local"
+)
+
+const defaultLocalStoreFileName = "downloads.json"
+
+// Keeps the generated device ID next to the config file, TempFolder may be
+// cleared and a new ID would leave the old one registered for good
+const deviceIdFileName = "device-id"
+
+const defaultHeartbeatSeconds = 300
+
+// What happens when a ROM with the same name is already installed
+const (
+	ConflictOverwrite     = "overwrite"
+	ConflictSkip          = "skip"
+	ConflictRename        = "rename"
+	ConflictKeepNewer     = "keepNewer"
+	ConflictSkipIdentical = "skipIdentical"
+)
+
+const defaultConflictKey = "default"
+
+var conflictPolicies = []string{
+	ConflictOverwrite,
+	ConflictSkip,
+	ConflictRename,
+	ConflictKeepNewer,
+	ConflictSkipIdentical,
+}
+
+const (
+	defaultMaxTotalBytes       = 8 << 30
+	defaultMaxEntries          = 10000
+	defaultMaxCompressionRatio = 200
+	defaultMaxFileBytes        = 4 << 30
+	defaultMinFreeBytes        = 256 << 20
+)
+
+const (
+	defaultDownloadWorkers = 2
+	defaultInstallWorkers  = 1
+	defaultPersistWorkers  = 1
+)
+
+const (
+	defaultMaxAttempts    = 5
+	defaultInitialDelayMs = 1000
+	defaultMaxDelayMs     = 60000
+	defaultMultiplier     = 2
+)
+
 func GetConfiguration() (*LoaderConfig, error) {
 	if _, err := os.Stat(configFileName); os.IsNotExist(err) {
 		return nil, fmt.Errorf(
@@ -46,6 +143,28 @@ func GetConfiguration() (*LoaderConfig, error) {
 		return nil, err
 	}
 
+	if config.MessageSource == "" {
+		config.MessageSource = MessageSourcePubSub
+	}
+	if config.DeviceID == "" {
+		config.DeviceID, err = loadOrCreateDeviceId(filepath.Join(filepath.Dir(configFileName), deviceIdFileName), config.TempFolder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.HeartbeatSeconds <= 0 {
+		config.HeartbeatSeconds = defaultHeartbeatSeconds
+	}
+	if config.Persistence == "" {
+		config.Persistence = PersistenceFirestore
+	}
+	if config.LocalStoreFile == "" && config.TempFolder != "" {
+		config.LocalStoreFile = filepath.Join(config.TempFolder, defaultLocalStoreFileName)
+	}
+	applyExtractionLimitDefaults(&config.ExtractionLimits)
+	applyConcurrencyDefaults(&config.Concurrency)
+	applyRetryDefaults(&config.Retry)
+
 	err = validateConfig(config)
 	if err != nil {
 		return nil, err
@@ -56,20 +175,39 @@ func GetConfiguration() (*LoaderConfig, error) {
 
 func validateConfig(config *LoaderConfig) error {
 	var missingFields []string
-	if config.CredentialsFileName == "" {
-		missingFields = append(missingFields, "credentialsFileName")
+	if config.UsesCloud() {
+		if config.CredentialsFileName == "" {
+			missingFields = append(missingFields, "credentialsFileName")
+		}
+
+		if config.ProjectID == "" {
+			missingFields = append(missingFields, "projectId")
+		}
 	}
 
-	if config.SubscriptionName == "" {
-		missingFields = append(missingFields, "subscriptionName")
+	switch config.MessageSource {
+	case MessageSourcePubSub:
+		if config.SubscriptionName == "" {
+			missingFields = append(missingFields, "subscriptionName")
+		}
+
+		if config.TopicName == "" {
+			missingFields = append(missingFields, "topicName")
+		}
+	case MessageSourceDropFolder:
+		if config.DropFolder == "" {
+			missingFields = append(missingFields, "dropFolder")
+		}
+	default:
+		return fmt.Errorf("unknown message source: %s", config.MessageSource)
 	}
 
-	if config.TopicName == "" {
-		missingFields = append(missingFields, "topicName")
+	if config.DeviceID == "" {
+		missingFields = append(missingFields, "deviceId")
 	}
 
-	if config.ProjectID == "" {
-		missingFields = append(missingFields, "projectId")
+	if config.Persistence != PersistenceFirestore && config.Persistence != PersistenceLocal {
+		return fmt.Errorf("unknown persistence: %s", config.Persistence)
 	}
 
 	if config.TempFolder == "" {
@@ -83,5 +221,117 @@ func validateConfig(config *LoaderConfig) error {
 	if len(missingFields) > 0 {
 		return errors.New("missing fields: " + strings.Join(missingFields, ", "))
 	}
+
+	for romType, policy := range config.OnConflict {
+		if !slices.Contains(conflictPolicies, policy) {
+			return fmt.Errorf(
+				"unknown onConflict policy %s for %s, expected one of: %s",
+				policy, romType, strings.Join(conflictPolicies, ", "))
+		}
+	}
 	return nil
 }
+
+// loadOrCreateDeviceId returns the device ID generated on the first start.
+// Earlier versions kept it in TempFolder, that ID is taken over.
+func loadOrCreateDeviceId(deviceIdPath string, tempFolder string) (string, error) {
+	deviceId, err := readDeviceId(deviceIdPath)
+	if err != nil || deviceId != "" {
+		return deviceId, err
+	}
+
+	if tempFolder != "" {
+		deviceId, err = readDeviceId(filepath.Join(tempFolder, deviceIdFileName))
+		if err != nil {
+			return "", err
+		}
+	}
+	if deviceId == "" {
+		deviceId = uuid.NewString()
+		log.Printf("Generated device id %s", deviceId)
+	}
+
+	if err := os.WriteFile(deviceIdPath, []byte(deviceId+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write device id %s: %w", deviceIdPath, err)
+	}
+	return deviceId, nil
+}
+
+// readDeviceId returns an empty ID when the file does not exist.
+func readDeviceId(deviceIdPath string) (string, error) {
+	content, err := os.ReadFile(deviceIdPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read device id %s: %w", deviceIdPath, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// UsesPubSub tells whether messages come from Pub/Sub and the ROMs from GCS.
+func (c *LoaderConfig) UsesPubSub() bool {
+	return c.MessageSource == MessageSourcePubSub
+}
+
+// UsesCloud tells whether any GCP service is needed, a drop folder with local
+// persistence runs without credentials.
+func (c *LoaderConfig) UsesCloud() bool {
+	return c.UsesPubSub() || c.Persistence == PersistenceFirestore
+}
+
+// ConflictPolicy returns the collision policy for the ROM type, overwriting by default.
+func (c *LoaderConfig) ConflictPolicy(romType string) string {
+	if policy, exists := c.OnConflict[romType]; exists {
+		return policy
+	}
+	if policy, exists := c.OnConflict[defaultConflictKey]; exists {
+		return policy
+	}
+	return ConflictOverwrite
+}
+
+func applyExtractionLimitDefaults(limits *ExtractionLimits) {
+	if limits.MaxTotalBytes == 0 {
+		limits.MaxTotalBytes = defaultMaxTotalBytes
+	}
+	if limits.MaxEntries == 0 {
+		limits.MaxEntries = defaultMaxEntries
+	}
+	if limits.MaxCompressionRatio == 0 {
+		limits.MaxCompressionRatio = defaultMaxCompressionRatio
+	}
+	if limits.MaxFileBytes == 0 {
+		limits.MaxFileBytes = defaultMaxFileBytes
+	}
+	if limits.MinFreeBytes == 0 {
+		limits.MinFreeBytes = defaultMinFreeBytes
+	}
+}
+
+func applyConcurrencyDefaults(concurrency *Concurrency) {
+	if concurrency.Download <= 0 {
+		concurrency.Download = defaultDownloadWorkers
+	}
+	if concurrency.Install <= 0 {
+		concurrency.Install = defaultInstallWorkers
+	}
+	if concurrency.Persist <= 0 {
+		concurrency.Persist = defaultPersistWorkers
+	}
+}
+
+func applyRetryDefaults(retry *RetryPolicy) {
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = defaultMaxAttempts
+	}
+	if retry.InitialDelayMs <= 0 {
+		retry.InitialDelayMs = defaultInitialDelayMs
+	}
+	if retry.MaxDelayMs <= 0 {
+		retry.MaxDelayMs = defaultMaxDelayMs
+	}
+	if retry.Multiplier < 1 {
+		retry.Multiplier = defaultMultiplier
+	}
+}
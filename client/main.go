@@ -2,18 +2,21 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"rom-downloader/config"
 	"rom-downloader/persistence"
+	"rom-downloader/pipeline"
 	"rom-downloader/storage/gcs"
 	"rom-downloader/storage/local"
 	"rom-downloader/subscribing"
 	"syscall"
 )
 
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	configuration, err := config.GetConfiguration()
 	if err != nil {
@@ -31,47 +34,54 @@ func main() {
 		cancel()
 	}()
 
-	gcsClient := gcs.NewGcsClient(ctx, configuration)
+	// Dropped files need no download
+	var gcsClient *gcs.Client
+	if configuration.UsesPubSub() {
+		gcsClient = gcs.NewGcsClient(ctx, configuration)
+		defer func() {
+			if err := gcsClient.Close(); err != nil {
+				log.Printf("Error closing GCS client: %v", err)
+			}
+		}()
+	}
+
+	journal, err := pipeline.OpenJournal(configuration.TempFolder)
+	if err != nil {
+		log.Fatalf("Error opening job journal: %v", err)
+	}
 	defer func() {
-		if err := gcsClient.Close(); err != nil {
-			log.Printf("Error closing GCS client: %v", err)
+		if err := journal.Close(); err != nil {
+			log.Printf("Error closing job journal: %v", err)
 		}
 	}()
 
 	fsClient := local.NewFsClient(configuration)
+	fsClient.SweepStaleJobs(journal.UnfinishedJobIds())
 
-	firestoreService, err := persistence.NewFirestoreService(ctx, configuration)
+	store, err := persistence.NewDownloadStore(ctx, configuration)
 	if err != nil {
-		log.Fatalf("Error creating firestore service: %v", err)
+		log.Fatalf("Error opening download store: %v", err)
+	}
+	if err := store.RegisterDevice(persistence.NewDevice(configuration, version)); err != nil {
+		log.Printf("Error registering device %s: %v", configuration.DeviceID, err)
 	}
+	go persistence.RunHeartbeat(ctx, configuration, store, version)
 
-	messages := make(chan subscribing.RomUploadedMessage, 10)
+	messageSource, err := subscribing.NewMessageSource(configuration)
+	if err != nil {
+		log.Fatalf("Error creating message source: %v", err)
+	}
+
+	messages := make(chan subscribing.ReceivedMessage, 10)
 	go func() {
-		subscribing.StartSubscriber(
-			ctx,
-			configuration,
-			messages)
+		if err := messageSource.Start(ctx, messages); err != nil {
+			log.Fatalf("Error receiving messages: %v", err)
+		}
 		close(messages)
 	}()
 
-	for message := range messages {
-		localFilePath, err := gcsClient.DownloadFile(&message)
-		if err != nil {
-			log.Printf("Error downloading file %s: %v", message.File, err)
-			continue
-		}
-		fmt.Printf("Downloaded file %s\n", message.File)
-		err = fsClient.ProcessLocalFile(localFilePath)
-		if err != nil {
-			log.Printf("Error processing file %s: %v", message.File, err)
-		}
-
-		completeDownload := persistence.CompleteDownloadFromMessage(&message)
-		err = firestoreService.CreateCompleteDownloadDoc(completeDownload)
-		if err != nil {
-			log.Printf("Error writing complete download to firestore: %v", err)
-		}
-	}
+	processingPipeline := pipeline.NewPipeline(ctx, configuration, gcsClient, fsClient, store, journal)
+	processingPipeline.Run(messages)
 
 	log.Println("Shutting down...")
 }
@@ -3,56 +3,233 @@ package persistence
 import (
 	"cloud.google.com/go/firestore"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"log"
 	"rom-downloader/config"
+	"strings"
+	"sync"
+	"time"
 )
 
+// FirestoreService connects on first use, so the client can start and keep
+// installing ROMs while Firestore is out of reach.
 type FirestoreService struct {
+	mu     sync.Mutex
 	client *firestore.Client
 	ctx    context.Context
 	config *config.LoaderConfig
 }
 
-const completeDownloadCollection = "complete"
+const (
+	completeDownloadCollection = "complete"
+	failedDownloadCollection   = "failures"
+	deviceCollection           = "devices"
+)
+
+func NewFirestoreService(ctx context.Context, config *config.LoaderConfig) *FirestoreService {
+	service := &FirestoreService{ctx: ctx, config: config}
+	go service.closeOnContext()
+	return service
+}
+
+// RecordCompletion stores the download once, redeliveries of the same
+// object generation find the document already there and leave it untouched.
+func (s *FirestoreService) RecordCompletion(download *CompleteDownload) error {
+	documentId := s.completeDownloadDocumentId(download.BucketName, download.FileName, download.Generation)
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Collection(completeDownloadCollection).Doc(documentId).Create(s.ctx, download)
+	if status.Code(err) == codes.AlreadyExists {
+		log.Printf("Success document for file %s already exists", download.FileName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Created success document to firestore for file %s", download.FileName)
+	return nil
+}
+
+// IsProcessed tells whether this device already installed the object generation.
+func (s *FirestoreService) IsProcessed(bucketName string, fileName string, generation int64) (bool, error) {
+	documentId := s.completeDownloadDocumentId(bucketName, fileName, generation)
+	client, err := s.getClient()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = client.Collection(completeDownloadCollection).Doc(documentId).Get(s.ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-func NewFirestoreService(ctx context.Context, config *config.LoaderConfig) (*FirestoreService, error) {
-	client, err := firestore.NewClient(ctx, config.ProjectID, option.WithCredentialsFile(config.CredentialsFileName))
+// History returns the most recent downloads, newest first.
+func (s *FirestoreService) History(limit int) ([]CompleteDownload, error) {
+	client, err := s.getClient()
 	if err != nil {
 		return nil, err
 	}
 
-	service := &FirestoreService{client: client, ctx: ctx, config: config}
-	go service.closeOnContext()
-	return service, nil
+	documents, err := client.Collection(completeDownloadCollection).
+		OrderBy("downloadedAt", firestore.Desc).
+		Limit(limit).
+		Documents(s.ctx).
+		GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	downloads := make([]CompleteDownload, 0, len(documents))
+	for _, document := range documents {
+		var download CompleteDownload
+		if err := document.DataTo(&download); err != nil {
+			return nil, fmt.Errorf("failed to read document %s: %w", document.Ref.ID, err)
+		}
+		downloads = append(downloads, download)
+	}
+	return downloads, nil
 }
 
-func (s *FirestoreService) CreateCompleteDownloadDoc(download *CompleteDownload) error {
-	err := s.writeDocument(completeDownloadCollection, nil, download)
+// RecordFailure stores the failure under the message and device, so repeated
+// failures of the same upload keep updating one document.
+func (s *FirestoreService) RecordFailure(failure *FailedDownload) error {
+	documentId := failureDocumentId(failure.DeviceId, failure.MessageId)
+	err := s.writeDocument(failedDownloadCollection, &documentId, failure)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Created success document to firestore for file %s", download.FileName)
+	log.Printf("Created failure document to firestore for file %s", failure.FileName)
+	return nil
+}
+
+// ResolveFailure marks the failure of the message on this device as resolved,
+// messages that never failed are ignored.
+func (s *FirestoreService) ResolveFailure(messageId string) error {
+	documentId := failureDocumentId(s.config.DeviceID, messageId)
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Collection(failedDownloadCollection).Doc(documentId).Update(s.ctx, []firestore.Update{
+		{Path: "resolved", Value: true},
+		{Path: "resolvedAt", Value: time.Now().UTC()},
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Resolved failure document of message %s", messageId)
 	return nil
 }
 
+// RegisterDevice creates the device document, a known device only gets its
+// details refreshed and keeps the time it was registered at first.
+func (s *FirestoreService) RegisterDevice(device *Device) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Collection(deviceCollection).Doc(device.DeviceId).Create(s.ctx, device)
+	if status.Code(err) == codes.AlreadyExists {
+		return s.Heartbeat(device)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Registered device %s", device.DeviceId)
+	return nil
+}
+
+// Heartbeat updates an already registered device only, a heartbeat creating
+// the document would leave it without the registration time.
+func (s *FirestoreService) Heartbeat(device *Device) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Collection(deviceCollection).Doc(device.DeviceId).Update(s.ctx, []firestore.Update{
+		{Path: "hostname", Value: device.Hostname},
+		{Path: "version", Value: device.Version},
+		{Path: "consoles", Value: device.Consoles},
+		{Path: "freeBytes", Value: device.FreeBytes},
+		{Path: "lastSeenAt", Value: device.LastSeenAt},
+	})
+	if status.Code(err) == codes.NotFound {
+		log.Printf("Device %s is not registered yet, skipping heartbeat", device.DeviceId)
+		return nil
+	}
+	return err
+}
+
 func (s *FirestoreService) writeDocument(collectionName string, documentId *string, data interface{}) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
 	var docRef *firestore.DocumentRef
 
 	if documentId == nil {
-		docRef = s.client.Collection(collectionName).NewDoc()
+		docRef = client.Collection(collectionName).NewDoc()
 	} else {
-		docRef = s.client.Collection(collectionName).Doc(*documentId)
+		docRef = client.Collection(collectionName).Doc(*documentId)
 	}
 
-	_, err := docRef.Set(s.ctx, data)
+	_, err = docRef.Set(s.ctx, data)
 	return err
 }
 
+func (s *FirestoreService) getClient() (*firestore.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	client, err := firestore.NewClient(s.ctx, s.config.ProjectID, option.WithCredentialsFile(s.config.CredentialsFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create firestore client: %w", err)
+	}
+
+	s.client = client
+	return client, nil
+}
+
 func (s *FirestoreService) closeOnContext() {
 	<-s.ctx.Done()
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return
+	}
+
 	err := s.client.Close()
 	if err != nil {
 		log.Printf("Error closing Firestore client: %v", err)
@@ -60,3 +237,16 @@ func (s *FirestoreService) closeOnContext() {
 		log.Println("Firestore client closed gracefully")
 	}
 }
+
+// completeDownloadDocumentId hashes the key, object names may contain slashes
+// and be longer than a document ID is allowed to be.
+func (s *FirestoreService) completeDownloadDocumentId(bucketName string, fileName string, generation int64) string {
+	key := fmt.Sprintf("%s/%s#%d@%s", bucketName, fileName, generation, s.config.DeviceID)
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func failureDocumentId(deviceId string, messageId string) string {
+	// Document IDs can not contain slashes
+	return strings.ReplaceAll(deviceId+"_"+messageId, "/", "_")
+}
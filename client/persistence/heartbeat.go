@@ -0,0 +1,27 @@
+package persistence
+
+import (
+	"context"
+	"log"
+	"rom-downloader/config"
+	"time"
+)
+
+// RunHeartbeat refreshes the device in the registry every configured interval
+// until the context is done.
+func RunHeartbeat(ctx context.Context, configuration *config.LoaderConfig, store DownloadStore, version string) {
+	ticker := time.NewTicker(time.Duration(configuration.HeartbeatSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := store.Heartbeat(NewDevice(configuration, version)); err != nil {
+			log.Printf("Error sending heartbeat of device %s: %v", configuration.DeviceID, err)
+		}
+	}
+}
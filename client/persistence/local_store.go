@@ -0,0 +1,141 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"rom-downloader/storage/local"
+	"slices"
+	"sync"
+	"time"
+)
+
+// LocalStore keeps the download history in a JSON file on the device, for
+// setups without Firestore.
+type LocalStore struct {
+	mu   sync.Mutex
+	path string
+	data localStoreData
+}
+
+type localStoreData struct {
+	Downloads []CompleteDownload `json:"downloads"`
+	Failures  []FailedDownload   `json:"failures"`
+}
+
+func OpenLocalStore(path string) (*LocalStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+
+	store := &LocalStore{path: path}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local store %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(content, &store.data); err != nil {
+		return nil, fmt.Errorf("failed to decode local store %s: %w", path, err)
+	}
+	return store, nil
+}
+
+func (s *LocalStore) RecordCompletion(download *CompleteDownload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.indexOfDownload(download.BucketName, download.FileName, download.Generation) != -1 {
+		return nil
+	}
+
+	s.data.Downloads = append(s.data.Downloads, *download)
+	return s.save()
+}
+
+// RecordFailure replaces the previous failure of the same message.
+func (s *LocalStore) RecordFailure(failure *FailedDownload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := slices.IndexFunc(s.data.Failures, func(existing FailedDownload) bool {
+		return existing.MessageId == failure.MessageId
+	})
+	if index == -1 {
+		s.data.Failures = append(s.data.Failures, *failure)
+	} else {
+		s.data.Failures[index] = *failure
+	}
+	return s.save()
+}
+
+func (s *LocalStore) ResolveFailure(messageId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := slices.IndexFunc(s.data.Failures, func(existing FailedDownload) bool {
+		return existing.MessageId == messageId
+	})
+	if index == -1 || s.data.Failures[index].Resolved {
+		return nil
+	}
+
+	resolvedAt := time.Now().UTC()
+	s.data.Failures[index].Resolved = true
+	s.data.Failures[index].ResolvedAt = &resolvedAt
+	return s.save()
+}
+
+// RegisterDevice does nothing, the history in the file belongs to this device only.
+func (s *LocalStore) RegisterDevice(_ *Device) error {
+	return nil
+}
+
+// Heartbeat does nothing, there is no registry to keep up to date.
+func (s *LocalStore) Heartbeat(_ *Device) error {
+	return nil
+}
+
+func (s *LocalStore) History(limit int) ([]CompleteDownload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	downloads := slices.Clone(s.data.Downloads)
+	slices.SortStableFunc(downloads, func(first CompleteDownload, second CompleteDownload) int {
+		return second.DownloadedAt.Compare(first.DownloadedAt)
+	})
+
+	if limit > 0 && len(downloads) > limit {
+		downloads = downloads[:limit]
+	}
+	return downloads, nil
+}
+
+func (s *LocalStore) IsProcessed(bucketName string, fileName string, generation int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.indexOfDownload(bucketName, fileName, generation) != -1, nil
+}
+
+func (s *LocalStore) indexOfDownload(bucketName string, fileName string, generation int64) int {
+	return slices.IndexFunc(s.data.Downloads, func(download CompleteDownload) bool {
+		return download.BucketName == bucketName && download.FileName == fileName && download.Generation == generation
+	})
+}
+
+func (s *LocalStore) save() error {
+	content, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode local store: %w", err)
+	}
+
+	return local.WriteFileAtomic(s.path, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
@@ -1,24 +1,173 @@
 package persistence
 
 import (
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"rom-downloader/config"
+	"rom-downloader/storage/gcs"
+	"rom-downloader/storage/local"
 	"rom-downloader/subscribing"
+	"slices"
 	"time"
 )
 
 type CompleteDownload struct {
-	MessageId    string    `firestore:"messageId"`
-	FileName     string    `firestore:"fileName"`
-	BucketName   string    `firestore:"bucketName"`
-	DownloadedAt time.Time `firestore:"downloadedAt"`
-	IsDeleted    bool      `firestore:"isDeleted"`
-}
-
-func CompleteDownloadFromMessage(msg *subscribing.RomUploadedMessage) *CompleteDownload {
-	return &CompleteDownload{
-		MessageId:    msg.MessageId,
-		FileName:     msg.File,
-		BucketName:   msg.Bucket,
-		DownloadedAt: time.Now().UTC(),
-		IsDeleted:    false,
+	MessageId          string       `firestore:"messageId" json:"messageId"`
+	FileName           string       `firestore:"fileName" json:"fileName"`
+	BucketName         string       `firestore:"bucketName" json:"bucketName"`
+	DeviceId           string       `firestore:"deviceId" json:"deviceId"`
+	Generation         int64        `firestore:"generation" json:"generation"`
+	Size               int64        `firestore:"size" json:"size"`
+	DownloadedAt       time.Time    `firestore:"downloadedAt" json:"downloadedAt"`
+	DownloadDurationMs int64        `firestore:"downloadDurationMs" json:"downloadDurationMs"`
+	ExtractDurationMs  int64        `firestore:"extractDurationMs" json:"extractDurationMs"`
+	ArchiveMembers     int          `firestore:"archiveMembers" json:"archiveMembers"` // Zero when the object is not an archive
+	Consoles           []string     `firestore:"consoles" json:"consoles"`
+	Files              []FileRecord `firestore:"files" json:"files"`
+	IsDeleted          bool         `firestore:"isDeleted" json:"isDeleted"`
+	DeletedAt          *time.Time   `firestore:"deletedAt,omitempty" json:"deletedAt,omitempty"` // Set by the cleaner
+}
+
+// FileRecord is one file of the download and what happened to it on the device.
+type FileRecord struct {
+	FileName        string `firestore:"fileName" json:"fileName"`
+	Console         string `firestore:"console" json:"console"`
+	DestinationPath string `firestore:"destinationPath" json:"destinationPath"` // Empty when the file was skipped
+	Size            int64  `firestore:"size" json:"size"`
+	Sha1            string `firestore:"sha1" json:"sha1"`
+	Crc32           string `firestore:"crc32" json:"crc32"`
+	Conflict        bool   `firestore:"conflict" json:"conflict"`
+	Policy          string `firestore:"policy" json:"policy"`
+	Decision        string `firestore:"decision" json:"decision"`
+}
+
+// Device is a client the cleaner waits for, objects uploaded after it was
+// registered are deleted only once it confirmed them.
+type Device struct {
+	DeviceId     string    `firestore:"deviceId" json:"deviceId"`
+	RegisteredAt time.Time `firestore:"registeredAt" json:"registeredAt"`
+	Hostname     string    `firestore:"hostname" json:"hostname"`
+	Version      string    `firestore:"version" json:"version"`
+	Consoles     []string  `firestore:"consoles" json:"consoles"`
+	FreeBytes    int64     `firestore:"freeBytes" json:"freeBytes"` // Free space on DestinationFolderRoot, -1 when unknown
+	LastSeenAt   time.Time `firestore:"lastSeenAt" json:"lastSeenAt"`
+}
+
+// FailedDownload is an upload a device gave up on. It is resolved once a later
+// delivery of the same message gets installed.
+type FailedDownload struct {
+	MessageId  string     `firestore:"messageId" json:"messageId"`
+	FileName   string     `firestore:"fileName" json:"fileName"`
+	BucketName string     `firestore:"bucketName" json:"bucketName"`
+	Stage      string     `firestore:"stage" json:"stage"`
+	ErrorClass string     `firestore:"errorClass" json:"errorClass"`
+	Error      string     `firestore:"error" json:"error"`
+	Attempts   int        `firestore:"attempts" json:"attempts"`
+	DeviceId   string     `firestore:"deviceId" json:"deviceId"`
+	FailedAt   time.Time  `firestore:"failedAt" json:"failedAt"`
+	Resolved   bool       `firestore:"resolved" json:"resolved"`
+	ResolvedAt *time.Time `firestore:"resolvedAt" json:"resolvedAt"`
+}
+
+func CompleteDownloadFromMessage(
+	msg *subscribing.RomUploadedMessage,
+	deviceId string,
+	download *gcs.DownloadResult,
+	extracted *local.ExtractResult,
+	result *local.ProcessResult,
+) *CompleteDownload {
+	completeDownload := &CompleteDownload{
+		MessageId:         msg.MessageId,
+		FileName:          msg.File,
+		BucketName:        msg.Bucket,
+		DeviceId:          deviceId,
+		DownloadedAt:      time.Now().UTC(),
+		ExtractDurationMs: extracted.Duration.Milliseconds(),
+		IsDeleted:         false,
+		Files:             fileRecordsFromResult(result),
+	}
+
+	// Jobs journaled by older versions do not know their download
+	if download != nil {
+		completeDownload.Generation = download.Generation
+		completeDownload.Size = download.Size
+		completeDownload.DownloadDurationMs = download.Duration.Milliseconds()
+	}
+
+	if extracted.Archive {
+		completeDownload.ArchiveMembers = len(extracted.Files)
+	}
+
+	for _, file := range completeDownload.Files {
+		if !slices.Contains(completeDownload.Consoles, file.Console) {
+			completeDownload.Consoles = append(completeDownload.Consoles, file.Console)
+		}
+	}
+	return completeDownload
+}
+
+func fileRecordsFromResult(result *local.ProcessResult) []FileRecord {
+	var records []FileRecord
+	for _, file := range result.Files {
+		records = append(records, FileRecord{
+			FileName:        filepath.Base(file.SourcePath),
+			Console:         file.RomType,
+			DestinationPath: file.DestinationPath,
+			Size:            file.Size,
+			Sha1:            file.Sha1,
+			Crc32:           file.Crc32,
+			Conflict:        file.Conflict,
+			Policy:          file.Policy,
+			Decision:        file.Decision,
+		})
+	}
+	return records
+}
+
+// NewDevice describes this client as it is right now.
+func NewDevice(configuration *config.LoaderConfig, version string) *Device {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("Error getting hostname: %v", err)
+	}
+
+	freeBytes := int64(-1)
+	if available, err := local.FreeSpace(configuration.DestinationFolderRoot); err == nil {
+		freeBytes = int64(available)
+	}
+
+	consoles := slices.Sorted(maps.Keys(configuration.RomTypeDestinations))
+	now := time.Now().UTC()
+	return &Device{
+		DeviceId:     configuration.DeviceID,
+		RegisteredAt: now,
+		Hostname:     hostname,
+		Version:      version,
+		Consoles:     consoles,
+		FreeBytes:    freeBytes,
+		LastSeenAt:   now,
+	}
+}
+
+func FailedDownloadFromMessage(
+	msg *subscribing.RomUploadedMessage,
+	deviceId string,
+	stage string,
+	errorClass string,
+	err error,
+	attempts int,
+) *FailedDownload {
+	return &FailedDownload{
+		MessageId:  msg.MessageId,
+		FileName:   msg.File,
+		BucketName: msg.Bucket,
+		Stage:      stage,
+		ErrorClass: errorClass,
+		Error:      err.Error(),
+		Attempts:   attempts,
+		DeviceId:   deviceId,
+		FailedAt:   time.Now().UTC(),
 	}
 }
@@ -0,0 +1,260 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"rom-downloader/storage/local"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	outboxFileName = "firestore-outbox.jsonl"
+
+	outboxFlushInterval = 30 * time.Second
+	outboxMaxBackoff    = 10 * time.Minute
+)
+
+// Kinds of writes waiting in the outbox
+const (
+	outboxComplete = "complete"
+	outboxFailure  = "failure"
+	outboxResolve  = "resolve"
+	outboxDevice   = "device"
+)
+
+type outboxRecord struct {
+	Kind      string            `json:"kind"`
+	Complete  *CompleteDownload `json:"complete,omitempty"`
+	Failure   *FailedDownload   `json:"failure,omitempty"`
+	MessageId string            `json:"messageId,omitempty"`
+	Device    *Device           `json:"device,omitempty"`
+	QueuedAt  time.Time         `json:"queuedAt"`
+}
+
+// Outbox keeps writes to a remote store in a file under TempFolder until they
+// are flushed by a background goroutine, so records survive network outages and restarts.
+type Outbox struct {
+	mu      sync.Mutex
+	path    string
+	records []outboxRecord
+	ctx     context.Context
+	store   DownloadStore
+	wake    chan struct{}
+}
+
+func OpenOutbox(ctx context.Context, tempFolder string, store DownloadStore) (*Outbox, error) {
+	if err := os.MkdirAll(tempFolder, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %w", tempFolder, err)
+	}
+
+	outbox := &Outbox{
+		path:  filepath.Join(tempFolder, outboxFileName),
+		ctx:   ctx,
+		store: store,
+		wake:  make(chan struct{}, 1),
+	}
+	if err := outbox.load(); err != nil {
+		return nil, err
+	}
+	// Records appended after a half written line would be skipped with it on the next start
+	if err := outbox.rewrite(); err != nil {
+		return nil, err
+	}
+	if len(outbox.records) > 0 {
+		log.Printf("Outbox holds %d records from the previous run", len(outbox.records))
+	}
+
+	go outbox.flushLoop()
+	return outbox, nil
+}
+
+func (o *Outbox) RecordCompletion(download *CompleteDownload) error {
+	return o.enqueue(outboxRecord{Kind: outboxComplete, Complete: download})
+}
+
+func (o *Outbox) RecordFailure(failure *FailedDownload) error {
+	return o.enqueue(outboxRecord{Kind: outboxFailure, Failure: failure})
+}
+
+func (o *Outbox) ResolveFailure(messageId string) error {
+	return o.enqueue(outboxRecord{Kind: outboxResolve, MessageId: messageId})
+}
+
+func (o *Outbox) RegisterDevice(device *Device) error {
+	return o.enqueue(outboxRecord{Kind: outboxDevice, Device: device})
+}
+
+// Heartbeat bypasses the outbox, a heartbeat sent late would tell nothing.
+func (o *Outbox) Heartbeat(device *Device) error {
+	return o.store.Heartbeat(device)
+}
+
+// IsProcessed looks into the outbox first, then into the store. While the
+// store is out of reach the download is treated as not recorded, the
+// completion is recorded only once anyway.
+func (o *Outbox) IsProcessed(bucketName string, fileName string, generation int64) (bool, error) {
+	o.mu.Lock()
+	for _, record := range o.records {
+		if record.Kind != outboxComplete {
+			continue
+		}
+		if record.Complete.BucketName == bucketName && record.Complete.FileName == fileName && record.Complete.Generation == generation {
+			o.mu.Unlock()
+			return true, nil
+		}
+	}
+	o.mu.Unlock()
+
+	recorded, err := o.store.IsProcessed(bucketName, fileName, generation)
+	if err != nil {
+		log.Printf("Error checking download of file %s, downloading it anyway: %v", fileName, err)
+		return false, nil
+	}
+	return recorded, nil
+}
+
+// History returns the recorded downloads, the ones still waiting in the outbox are not included.
+func (o *Outbox) History(limit int) ([]CompleteDownload, error) {
+	return o.store.History(limit)
+}
+
+// enqueue durably stores the record before the call returns and wakes the flusher up.
+func (o *Outbox) enqueue(record outboxRecord) error {
+	record.QueuedAt = time.Now().UTC()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := local.AppendJSONLine(o.path, record); err != nil {
+		return err
+	}
+
+	o.records = append(o.records, record)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// flushLoop sends the records whenever new ones arrive or the interval passes,
+// backing off while Firestore keeps failing.
+func (o *Outbox) flushLoop() {
+	delay := outboxFlushInterval
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-o.ctx.Done():
+			return
+		case <-o.wake:
+		case <-timer.C:
+		}
+
+		if err := o.flush(); err != nil {
+			log.Printf("Error flushing outbox, retrying in %s: %v", delay, err)
+			delay = min(delay*2, outboxMaxBackoff)
+		} else {
+			delay = outboxFlushInterval
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+}
+
+// flush sends the records in order and stops at the first one that fails,
+// a failure has to reach Firestore before its resolution does.
+func (o *Outbox) flush() error {
+	o.mu.Lock()
+	pending := append([]outboxRecord(nil), o.records...)
+	o.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	sent := 0
+	var sendErr error
+	for _, record := range pending {
+		err := o.send(record)
+		if status.Code(err) == codes.InvalidArgument {
+			// Firestore would reject the record forever, it must not block the rest
+			log.Printf("Dropping outbox record %s queued at %s: %v", record.Kind, record.QueuedAt, err)
+			err = nil
+		}
+		if err != nil {
+			sendErr = err
+			break
+		}
+		sent++
+	}
+
+	if sent > 0 {
+		if err := o.remove(sent); err != nil {
+			return err
+		}
+	}
+	return sendErr
+}
+
+func (o *Outbox) send(record outboxRecord) error {
+	switch record.Kind {
+	case outboxComplete:
+		return o.store.RecordCompletion(record.Complete)
+	case outboxFailure:
+		return o.store.RecordFailure(record.Failure)
+	case outboxResolve:
+		return o.store.ResolveFailure(record.MessageId)
+	case outboxDevice:
+		return o.store.RegisterDevice(record.Device)
+	default:
+		log.Printf("Dropping outbox record of unknown kind %s", record.Kind)
+		return nil
+	}
+}
+
+// remove drops the first count records and rewrites the outbox file. Records
+// enqueued meanwhile were appended after them, so they are kept.
+func (o *Outbox) remove(count int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.records = o.records[count:]
+	return o.rewrite()
+}
+
+// rewrite replaces the outbox file with the records, the caller holds the lock
+// unless the flusher is not running yet.
+func (o *Outbox) rewrite() error {
+	return local.WriteFileAtomic(o.path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for _, record := range o.records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (o *Outbox) load() error {
+	return local.ReadJSONLines(o.path, func(record *outboxRecord) {
+		o.records = append(o.records, *record)
+	})
+}
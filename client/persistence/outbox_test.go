@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// offlineStore fails every write, the outbox keeps all of its records.
+type offlineStore struct {
+	DownloadStore
+}
+
+var errOffline = errors.New("offline")
+
+func (offlineStore) RecordCompletion(*CompleteDownload) error { return errOffline }
+func (offlineStore) RecordFailure(*FailedDownload) error      { return errOffline }
+func (offlineStore) ResolveFailure(string) error              { return errOffline }
+func (offlineStore) RegisterDevice(*Device) error             { return errOffline }
+
+func openOfflineOutbox(t *testing.T, tempFolder string) *Outbox {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	outbox, err := OpenOutbox(ctx, tempFolder, offlineStore{})
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	return outbox
+}
+
+func (o *Outbox) recordKinds() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var kinds []string
+	for _, record := range o.records {
+		kinds = append(kinds, record.Kind)
+	}
+	return kinds
+}
+
+func TestOutboxKeepsRecordsAppendedAfterTornLine(t *testing.T) {
+	tempFolder := t.TempDir()
+	outboxPath := filepath.Join(tempFolder, outboxFileName)
+
+	// A power loss cut the last record in half
+	content := `{"kind":"resolve","messageId":"first","queuedAt":"2024-05-01T12:00:00Z"}` + "\n" + `{"kind":"resolve","messa`
+	if err := os.WriteFile(outboxPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write outbox: %v", err)
+	}
+
+	outbox := openOfflineOutbox(t, tempFolder)
+	if err := outbox.ResolveFailure("second"); err != nil {
+		t.Fatalf("failed to enqueue record: %v", err)
+	}
+
+	reopened := openOfflineOutbox(t, tempFolder)
+	if kinds := reopened.recordKinds(); len(kinds) != 2 {
+		t.Fatalf("expected both records to survive the restart, got %v", kinds)
+	}
+}
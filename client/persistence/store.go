@@ -0,0 +1,37 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"rom-downloader/config"
+)
+
+// DownloadStore keeps track of what the client installed and what it gave up on.
+type DownloadStore interface {
+	// RecordCompletion stores the download, recording the same object generation again is a no-op.
+	RecordCompletion(download *CompleteDownload) error
+	RecordFailure(failure *FailedDownload) error
+	// ResolveFailure marks the failure of the message as resolved, messages that never failed are ignored.
+	ResolveFailure(messageId string) error
+	// History returns the most recent downloads, newest first.
+	History(limit int) ([]CompleteDownload, error)
+	// RegisterDevice adds the device to the registry, registering it again keeps the original registration.
+	RegisterDevice(device *Device) error
+	// Heartbeat refreshes what the registry knows about the device and when it was last seen.
+	Heartbeat(device *Device) error
+	// IsProcessed tells whether the object generation was already installed.
+	IsProcessed(bucketName string, fileName string, generation int64) (bool, error)
+}
+
+// NewDownloadStore creates the store selected in the configuration. Firestore
+// writes go through the outbox, so they survive being offline.
+func NewDownloadStore(ctx context.Context, configuration *config.LoaderConfig) (DownloadStore, error) {
+	switch configuration.Persistence {
+	case config.PersistenceFirestore:
+		return OpenOutbox(ctx, configuration.TempFolder, NewFirestoreService(ctx, configuration))
+	case config.PersistenceLocal:
+		return OpenLocalStore(configuration.LocalStoreFile)
+	default:
+		return nil, fmt.Errorf("unknown persistence: %s", configuration.Persistence)
+	}
+}
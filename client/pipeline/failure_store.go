@@ -0,0 +1,39 @@
+package pipeline
+
+import (
+	"path/filepath"
+	"rom-downloader/storage/local"
+	"sync"
+	"time"
+)
+
+const failuresFileName = "failed-jobs.jsonl"
+
+// FailedJob describes a job that was given up on.
+type FailedJob struct {
+	JobId      string    `json:"jobId"`
+	Bucket     string    `json:"bucket"`
+	File       string    `json:"file"`
+	Stage      string    `json:"stage"`
+	ErrorClass string    `json:"errorClass"`
+	Error      string    `json:"error"`
+	Attempts   int       `json:"attempts"`
+	FailedAt   time.Time `json:"failedAt"`
+}
+
+// FailureStore keeps permanently failed jobs in an append-only file under TempFolder.
+type FailureStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFailureStore(tempFolder string) *FailureStore {
+	return &FailureStore{path: filepath.Join(tempFolder, failuresFileName)}
+}
+
+func (s *FailureStore) Record(failedJob FailedJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return local.AppendJSONLine(s.path, failedJob)
+}
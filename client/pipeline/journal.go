@@ -0,0 +1,224 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"rom-downloader/storage/gcs"
+	"rom-downloader/storage/local"
+	"rom-downloader/subscribing"
+	"sync"
+	"time"
+)
+
+// Stages a job goes through, each one is journaled once completed
+const (
+	StageReceived   = "received"
+	StageDownloaded = "downloaded"
+	StageExtracted  = "extracted"
+	StageInstalled  = "installed"
+	StageRecorded   = "recorded"
+	StageFailed     = "failed"
+)
+
+var stageOrder = map[string]int{
+	StageReceived:   0,
+	StageDownloaded: 1,
+	StageExtracted:  2,
+	StageInstalled:  3,
+	StageRecorded:   4,
+}
+
+const (
+	journalFileName = "jobs.journal"
+
+	// Recorded jobs are remembered for a while to settle Pub/Sub redeliveries
+	recordedRetention = 7 * 24 * time.Hour
+
+	// Every job appends a few entries, compacting keeps a long running client's journal small
+	compactAfterAppends = 1000
+)
+
+// JournalEntry is the last known state of a job.
+type JournalEntry struct {
+	JobId         string                         `json:"jobId"`
+	Stage         string                         `json:"stage"`
+	Message       subscribing.RomUploadedMessage `json:"message"`
+	LocalPath     string                         `json:"localPath,omitempty"`
+	LocalFilePath string                         `json:"localFilePath,omitempty"`
+	Download      *gcs.DownloadResult            `json:"download,omitempty"`
+	Extracted     *local.ExtractResult           `json:"extracted,omitempty"`
+	Result        *local.ProcessResult           `json:"result,omitempty"`
+	UpdatedAt     time.Time                      `json:"updatedAt"`
+}
+
+// withoutResults keeps what settling redeliveries of a recorded job needs.
+func (e JournalEntry) withoutResults() JournalEntry {
+	e.Download = nil
+	e.Extracted = nil
+	e.Result = nil
+	return e
+}
+
+// reached tells whether the job already completed the stage.
+func (e *JournalEntry) reached(stage string) bool {
+	return stageOrder[e.Stage] >= stageOrder[stage]
+}
+
+// Journal is an append-only log of job states under TempFolder, it lets the
+// client resume jobs after a restart or power loss.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]*JournalEntry
+	appends int // Since the last compaction
+}
+
+func OpenJournal(tempFolder string) (*Journal, error) {
+	if err := os.MkdirAll(tempFolder, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %w", tempFolder, err)
+	}
+
+	journal := &Journal{
+		path:    filepath.Join(tempFolder, journalFileName),
+		entries: make(map[string]*JournalEntry),
+	}
+
+	if err := journal.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := journal.compact(); err != nil {
+		return nil, err
+	}
+
+	return journal, nil
+}
+
+// Get returns a copy of the job entry, nil when the job is unknown.
+func (j *Journal) Get(jobId string) *JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, exists := j.entries[jobId]
+	if !exists {
+		return nil
+	}
+	entryCopy := *entry
+	return &entryCopy
+}
+
+// Unfinished returns the jobs that were not recorded yet.
+func (j *Journal) Unfinished() []*JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var unfinished []*JournalEntry
+	for _, entry := range j.entries {
+		if entry.Stage != StageRecorded {
+			entryCopy := *entry
+			unfinished = append(unfinished, &entryCopy)
+		}
+	}
+	return unfinished
+}
+
+func (j *Journal) UnfinishedJobIds() []string {
+	var jobIds []string
+	for _, entry := range j.Unfinished() {
+		jobIds = append(jobIds, entry.JobId)
+	}
+	return jobIds
+}
+
+// Update durably stores the new state of the job before the call returns.
+func (j *Journal) Update(entry JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry.UpdatedAt = time.Now().UTC()
+	if entry.Stage == StageRecorded {
+		entry = entry.withoutResults()
+	}
+	if err := j.append(&entry); err != nil {
+		return err
+	}
+
+	if entry.Stage == StageFailed {
+		delete(j.entries, entry.JobId)
+	} else {
+		j.entries[entry.JobId] = &entry
+	}
+
+	// The entry is already durable, a failed compaction is retried after the next append
+	j.appends++
+	if j.appends >= compactAfterAppends {
+		if err := j.compact(); err != nil {
+			log.Printf("Error compacting journal %s: %v", j.path, err)
+		}
+	}
+	return nil
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Close()
+}
+
+func (j *Journal) append(entry *JournalEntry) error {
+	return local.WriteJSONLine(j.file, entry)
+}
+
+// replay rebuilds the job states, the last line of every job wins.
+func (j *Journal) replay() error {
+	return local.ReadJSONLines(j.path, func(entry *JournalEntry) {
+		if entry.Stage == StageFailed {
+			delete(j.entries, entry.JobId)
+		} else {
+			j.entries[entry.JobId] = entry
+		}
+	})
+}
+
+// compact rewrites the journal with only the current job states, forgets
+// recorded jobs past their retention and opens the journal for appending.
+func (j *Journal) compact() error {
+	for jobId, entry := range j.entries {
+		if entry.Stage == StageRecorded && time.Since(entry.UpdatedAt) > recordedRetention {
+			delete(j.entries, jobId)
+		}
+	}
+
+	err := local.WriteFileAtomic(j.path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for _, entry := range j.entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open journal %s: %w", j.path, err)
+	}
+
+	if j.file != nil {
+		if err := j.file.Close(); err != nil {
+			log.Printf("Error closing compacted journal %s: %v", j.path, err)
+		}
+	}
+	j.file = file
+	j.appends = 0
+	return nil
+}
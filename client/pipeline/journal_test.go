@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"rom-downloader/storage/local"
+	"rom-downloader/subscribing"
+	"testing"
+	"time"
+)
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestJournalCompactsWhileRunning(t *testing.T) {
+	journal, err := OpenJournal(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	defer journal.Close()
+
+	// A recorded job from long ago is forgotten on the next compaction
+	journal.entries["old"] = &JournalEntry{JobId: "old", Stage: StageRecorded, UpdatedAt: time.Now().Add(-2 * recordedRetention)}
+
+	entry := JournalEntry{
+		JobId:     "job",
+		Message:   subscribing.RomUploadedMessage{MessageId: "job", Bucket: "roms", File: "game_snes.zip"},
+		Extracted: &local.ExtractResult{Files: []string{"game.sfc"}},
+		Result:    &local.ProcessResult{Files: []local.InstalledFile{{SourcePath: "game.sfc"}}},
+	}
+	for i := 0; i < compactAfterAppends+10; i++ {
+		entry.Stage = StageExtracted
+		if err := journal.Update(entry); err != nil {
+			t.Fatalf("failed to update journal: %v", err)
+		}
+	}
+
+	if lines := countLines(t, journal.path); lines >= compactAfterAppends {
+		t.Errorf("expected the journal to be compacted, it has %d lines", lines)
+	}
+	if journal.Get("old") != nil {
+		t.Error("expected the old recorded job to be forgotten")
+	}
+
+	entry.Stage = StageRecorded
+	if err := journal.Update(entry); err != nil {
+		t.Fatalf("failed to update journal: %v", err)
+	}
+	recorded := journal.Get("job")
+	if recorded == nil || recorded.Stage != StageRecorded {
+		t.Fatalf("expected the job to be recorded, got %+v", recorded)
+	}
+	if recorded.Extracted != nil || recorded.Result != nil {
+		t.Error("expected the recorded job to be kept without its results")
+	}
+
+	// The compacted journal replays to the same state
+	reopened, err := OpenJournal(filepath.Dir(journal.path))
+	if err != nil {
+		t.Fatalf("failed to reopen journal: %v", err)
+	}
+	defer reopened.Close()
+	if entry := reopened.Get("job"); entry == nil || entry.Stage != StageRecorded {
+		t.Errorf("expected the reopened journal to know the recorded job, got %+v", entry)
+	}
+}
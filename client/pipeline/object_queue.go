@@ -0,0 +1,58 @@
+package pipeline
+
+import "sync"
+
+// objectQueue lets one job per object into the pipeline, jobs for an object
+// that is already in flight are parked until it settles instead of holding a
+// worker, so different objects keep flowing.
+type objectQueue struct {
+	mu      sync.Mutex
+	waiting map[string][]*Job // Busy objects and the jobs parked behind them
+	parked  sync.WaitGroup
+}
+
+func newObjectQueue() *objectQueue {
+	return &objectQueue{waiting: make(map[string][]*Job)}
+}
+
+// admit tells whether the job may start now, otherwise it is parked until the
+// job ahead of it releases the object.
+func (q *objectQueue) admit(key string, job *Job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	parked, busy := q.waiting[key]
+	if busy {
+		q.waiting[key] = append(parked, job)
+		q.parked.Add(1)
+		return false
+	}
+
+	q.waiting[key] = nil
+	return true
+}
+
+// release hands the object over to the next parked job and returns it, nil
+// when nobody waits. The caller has to call parkedDone once the job got going.
+func (q *objectQueue) release(key string) *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	parked := q.waiting[key]
+	if len(parked) == 0 {
+		delete(q.waiting, key)
+		return nil
+	}
+
+	q.waiting[key] = parked[1:]
+	return parked[0]
+}
+
+func (q *objectQueue) parkedDone() {
+	q.parked.Done()
+}
+
+// wait blocks until every parked job got going.
+func (q *objectQueue) wait() {
+	q.parked.Wait()
+}
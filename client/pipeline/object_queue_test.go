@@ -0,0 +1,54 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObjectQueueParksJobsOfBusyObjects(t *testing.T) {
+	queue := newObjectQueue()
+	first, second, third, other := &Job{}, &Job{}, &Job{}, &Job{}
+
+	if !queue.admit("roms/game.zip", first) {
+		t.Fatal("expected the first job to be admitted")
+	}
+	if queue.admit("roms/game.zip", second) || queue.admit("roms/game.zip", third) {
+		t.Fatal("expected later jobs of the busy object to be parked")
+	}
+	if !queue.admit("roms/other.zip", other) {
+		t.Fatal("expected a job of another object to be admitted")
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		queue.wait()
+		close(waited)
+	}()
+
+	// Parked jobs start in order, each one once the one ahead of it settled
+	if next := queue.release("roms/game.zip"); next != second {
+		t.Fatalf("expected the second job to be next, got %p", next)
+	}
+	queue.parkedDone()
+
+	if next := queue.release("roms/game.zip"); next != third {
+		t.Fatalf("expected the third job to be next, got %p", next)
+	}
+
+	select {
+	case <-waited:
+		t.Fatal("expected wait to block while a parked job has not started")
+	case <-time.After(10 * time.Millisecond):
+	}
+	queue.parkedDone()
+
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("expected wait to return once every parked job started")
+	}
+
+	if next := queue.release("roms/other.zip"); next != nil {
+		t.Fatalf("expected no job parked behind the other object, got %p", next)
+	}
+}
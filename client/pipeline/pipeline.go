@@ -0,0 +1,451 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"rom-downloader/config"
+	"rom-downloader/persistence"
+	"rom-downloader/storage/gcs"
+	"rom-downloader/storage/local"
+	"rom-downloader/subscribing"
+	"sync"
+	"time"
+)
+
+// Steps reported when a job fails
+const (
+	stageDownload = "download"
+	stageExtract  = "extract"
+	stageInstall  = "install"
+	stagePersist  = "persist"
+	stageJournal  = "journal"
+)
+
+// Job is one message travelling through the pipeline stages.
+type Job struct {
+	JournalEntry
+	handles []subscribing.ReceivedMessage // Deliveries settled once the job finishes
+	release func()                        // Lets the next job for the object start
+}
+
+// Pipeline downloads, installs and records ROMs in separate worker pools, so
+// one big disc image does not hold back the small ROMs queued behind it.
+type Pipeline struct {
+	ctx          context.Context
+	config       *config.LoaderConfig
+	gcsClient    *gcs.Client
+	fsClient     *local.FsClient
+	store        persistence.DownloadStore
+	journal      *Journal
+	failureStore *FailureStore
+	objects      *objectQueue
+	jobs         chan *Job
+
+	mu       sync.Mutex
+	inFlight map[string]*Job
+}
+
+func NewPipeline(
+	ctx context.Context,
+	config *config.LoaderConfig,
+	gcsClient *gcs.Client,
+	fsClient *local.FsClient,
+	store persistence.DownloadStore,
+	journal *Journal,
+) *Pipeline {
+	return &Pipeline{
+		ctx:          ctx,
+		config:       config,
+		gcsClient:    gcsClient,
+		fsClient:     fsClient,
+		store:        store,
+		journal:      journal,
+		failureStore: NewFailureStore(config.TempFolder),
+		objects:      newObjectQueue(),
+		inFlight:     make(map[string]*Job),
+	}
+}
+
+// Run resumes the jobs left unfinished by the previous run, then processes
+// messages until the channel is closed and every job has left the pipeline.
+func (p *Pipeline) Run(messages <-chan subscribing.ReceivedMessage) {
+	p.jobs = make(chan *Job)
+	downloaded := make(chan *Job, p.config.Concurrency.Install)
+	installed := make(chan *Job, p.config.Concurrency.Persist)
+
+	go func() {
+		for _, entry := range p.journal.Unfinished() {
+			log.Printf("Resuming job %s for file %s from stage %s", entry.JobId, entry.Message.File, entry.Stage)
+			p.dispatch(p.track(&Job{JournalEntry: *entry}))
+		}
+
+		for message := range messages {
+			if job := p.accept(message); job != nil {
+				p.dispatch(job)
+			}
+		}
+
+		// Parked jobs are sent once the job ahead of them settles
+		p.objects.wait()
+		close(p.jobs)
+	}()
+
+	runStage(p.config.Concurrency.Download, p.jobs, downloaded, p.download)
+	runStage(p.config.Concurrency.Install, downloaded, installed, p.install)
+	runStage(p.config.Concurrency.Persist, installed, nil, p.persist)
+}
+
+// runStage processes jobs from input with the given number of workers and
+// blocks until all of them finished, jobs that succeed are passed to output.
+func runStage(workers int, input <-chan *Job, output chan<- *Job, process func(*Job) bool) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range input {
+				if process(job) && output != nil {
+					output <- job
+				}
+			}
+		}()
+	}
+
+	if output == nil {
+		wg.Wait()
+		return
+	}
+
+	go func() {
+		wg.Wait()
+		close(output)
+	}()
+}
+
+// accept turns a delivery into a job. Redeliveries of a job that is in flight
+// or already recorded are settled with it instead of being processed again.
+// A dropped file is removed once installed, seeing it again means it was
+// dropped again.
+func (p *Pipeline) accept(message subscribing.ReceivedMessage) *Job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if job, exists := p.inFlight[message.MessageId]; exists {
+		log.Printf("Message %s is already being processed", message.MessageId)
+		job.handles = append(job.handles, message)
+		return nil
+	}
+
+	entry := p.journal.Get(message.MessageId)
+	if entry != nil && entry.Stage == StageRecorded {
+		if !message.IsLocal() {
+			log.Printf("Message %s was already processed, acknowledging", message.MessageId)
+			message.Ack()
+			return nil
+		}
+		log.Printf("Dropped file %s was installed before, installing it again", message.LocalPath)
+		entry = nil
+	}
+
+	if entry == nil {
+		entry = &JournalEntry{
+			JobId:     message.MessageId,
+			Stage:     StageReceived,
+			Message:   message.RomUploadedMessage,
+			LocalPath: message.LocalPath,
+		}
+		if err := p.journal.Update(*entry); err != nil {
+			log.Printf("Error journaling message %s: %v", message.MessageId, err)
+			message.Nack()
+			return nil
+		}
+	}
+
+	job := &Job{JournalEntry: *entry, handles: []subscribing.ReceivedMessage{message}}
+	job.Message.LocalPath = job.LocalPath
+	p.inFlight[job.JobId] = job
+	return job
+}
+
+func (p *Pipeline) track(job *Job) *Job {
+	// The local path is not part of the message JSON
+	job.Message.LocalPath = job.LocalPath
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight[job.JobId] = job
+	return job
+}
+
+// dispatch sends the job to the download stage. Messages for the same object
+// wait for each other, they would share temp files, the later one is parked
+// without holding a worker.
+func (p *Pipeline) dispatch(job *Job) {
+	key := objectKey(&job.Message)
+
+	var once sync.Once
+	job.release = func() {
+		once.Do(func() {
+			next := p.objects.release(key)
+			if next == nil {
+				return
+			}
+			// Settling happens in stage workers, they must not wait for a download worker
+			go func() {
+				p.jobs <- next
+				p.objects.parkedDone()
+			}()
+		})
+	}
+
+	if p.objects.admit(key, job) {
+		p.jobs <- job
+	} else {
+		log.Printf("File %s is already being processed, job %s waits for it", job.Message.File, job.JobId)
+	}
+}
+
+func (p *Pipeline) download(job *Job) bool {
+	p.rewindMissingFiles(job)
+
+	if job.reached(StageDownloaded) {
+		return true
+	}
+
+	if job.Message.IsLocal() {
+		job.LocalFilePath = job.Message.LocalPath
+	} else if p.gcsClient == nil {
+		// A job journaled before the message source was switched away from Pub/Sub
+		err := fmt.Errorf("can not download file %s, GCS is not configured", job.Message.File)
+		log.Printf("Error downloading file %s: %v", job.Message.File, err)
+		p.fail(job, stageDownload, 1, err)
+		return false
+	} else {
+		var recorded bool
+		attempts, err := p.retry(job, stageDownload, func() error {
+			generation, err := p.gcsClient.GetGeneration(&job.Message)
+			if err != nil {
+				return err
+			}
+			recorded, err = p.store.IsProcessed(job.Message.Bucket, job.Message.File, generation)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error checking whether file %s was already downloaded: %v", job.Message.File, err)
+			p.fail(job, stageDownload, attempts, err)
+			return false
+		}
+
+		// Redelivered and replayed messages of an installed generation need no download
+		if recorded {
+			log.Printf("File %s was already installed, skipping download", job.Message.File)
+			if p.advance(job, StageRecorded) {
+				p.settle(job, true)
+			}
+			return false
+		}
+
+		var download *gcs.DownloadResult
+		attempts, err = p.retry(job, stageDownload, func() (err error) {
+			download, err = p.gcsClient.DownloadFile(&job.Message)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error downloading file %s: %v", job.Message.File, err)
+			p.fail(job, stageDownload, attempts, err)
+			return false
+		}
+		log.Printf("Downloaded file %s", job.Message.File)
+		job.LocalFilePath = download.FilePath
+		job.Download = download
+	}
+
+	return p.advance(job, StageDownloaded)
+}
+
+func (p *Pipeline) install(job *Job) bool {
+	if !job.reached(StageExtracted) {
+		var extracted *local.ExtractResult
+		attempts, err := p.retry(job, stageExtract, func() (err error) {
+			extracted, err = p.fsClient.Extract(job.JobId, job.LocalFilePath)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error extracting file %s: %v", job.Message.File, err)
+			p.fail(job, stageExtract, attempts, err)
+			return false
+		}
+
+		job.Extracted = extracted
+		if !p.advance(job, StageExtracted) {
+			return false
+		}
+	}
+
+	if !job.reached(StageInstalled) {
+		attempts, err := p.retry(job, stageInstall, func() error {
+			// Files moved by a failed attempt stay part of the result
+			result, err := p.fsClient.Install(job.Extracted, job.Result)
+			job.Result = result
+			return err
+		})
+		if err != nil {
+			log.Printf("Error processing file %s: %v", job.Message.File, err)
+			p.fail(job, stageInstall, attempts, err)
+			return false
+		}
+
+		// Not recognized files are let be, but a dropped file is the only copy
+		if job.Message.IsLocal() && len(job.Result.Files) == 0 {
+			err := &local.StageError{Stage: local.StageRoute, Err: fmt.Errorf("%w: %s", local.ErrRomTypeNotRecognized, job.Message.File)}
+			log.Printf("Error processing file %s: %v", job.Message.File, err)
+			p.fail(job, stageInstall, attempts, err)
+			return false
+		}
+
+		p.fsClient.Cleanup(job.JobId, job.LocalFilePath)
+		if !p.advance(job, StageInstalled) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Pipeline) persist(job *Job) bool {
+	// Dropped files have no bucket object the cleaner could delete
+	if !job.Message.IsLocal() {
+		completeDownload := persistence.CompleteDownloadFromMessage(&job.Message, p.config.DeviceID, job.Download, job.Extracted, job.Result)
+		attempts, err := p.retry(job, stagePersist, func() error {
+			return p.store.RecordCompletion(completeDownload)
+		})
+		if err != nil {
+			log.Printf("Error writing complete download to firestore: %v", err)
+			p.fail(job, stagePersist, attempts, err)
+			return false
+		}
+	}
+
+	if err := p.store.ResolveFailure(job.JobId); err != nil {
+		log.Printf("Error resolving failure of message %s: %v", job.JobId, err)
+	}
+
+	if !p.advance(job, StageRecorded) {
+		return false
+	}
+
+	p.settle(job, true)
+	return true
+}
+
+// rewindMissingFiles restarts a resumed job from scratch when the files its
+// last stage left behind are gone, for example after the temp folder was cleared.
+func (p *Pipeline) rewindMissingFiles(job *Job) {
+	missing := false
+	switch job.Stage {
+	case StageDownloaded:
+		missing = !local.FileExists(job.LocalFilePath)
+	case StageExtracted:
+		for _, filePath := range job.Extracted.Files {
+			missing = missing || !local.FileExists(filePath)
+		}
+	}
+
+	if missing {
+		log.Printf("Files of job %s are missing, starting it over", job.JobId)
+		job.Stage = StageReceived
+		job.Download = nil
+		job.Extracted = nil
+	}
+}
+
+// advance journals the completed stage, the job fails when it can not be stored.
+func (p *Pipeline) advance(job *Job, stage string) bool {
+	job.Stage = stage
+	if err := p.journal.Update(job.JournalEntry); err != nil {
+		log.Printf("Error journaling job %s: %v", job.JobId, err)
+		p.fail(job, stageJournal, 1, err)
+		return false
+	}
+	return true
+}
+
+// fail gives up on the job. It is kept in the failure store and nacked, so
+// Pub/Sub redelivers it until its dead letter policy takes over.
+func (p *Pipeline) fail(job *Job, stage string, attempts int, err error) {
+	// Jobs interrupted by shutdown keep their last stage and get resumed on the next start
+	if p.ctx.Err() != nil {
+		p.settle(job, false)
+		return
+	}
+
+	// Installing reports whether routing or moving the files failed
+	var stageError *local.StageError
+	if errors.As(err, &stageError) {
+		stage = stageError.Stage
+	}
+	errorClass := classifyError(err)
+
+	failedJob := FailedJob{
+		JobId:      job.JobId,
+		Bucket:     job.Message.Bucket,
+		File:       job.Message.File,
+		Stage:      stage,
+		ErrorClass: errorClass,
+		Error:      err.Error(),
+		Attempts:   attempts,
+		FailedAt:   time.Now().UTC(),
+	}
+	if err := p.failureStore.Record(failedJob); err != nil {
+		log.Printf("Error recording failed job %s: %v", job.JobId, err)
+	}
+
+	failedDownload := persistence.FailedDownloadFromMessage(&job.Message, p.config.DeviceID, stage, errorClass, err, attempts)
+	if err := p.store.RecordFailure(failedDownload); err != nil {
+		log.Printf("Error writing failure of file %s to firestore: %v", job.Message.File, err)
+	}
+
+	if job.Message.IsLocal() {
+		// The dropped file is the only copy, it waits in the failed folder to be dropped again
+		failedPath, err := p.fsClient.SetAsideFailed(job.JobId, job.Message.LocalPath)
+		if err != nil {
+			log.Printf("Error setting aside dropped file %s: %v", job.Message.LocalPath, err)
+		} else {
+			log.Printf("Moved dropped file %s to %s", job.Message.LocalPath, failedPath)
+		}
+		p.fsClient.CleanupJob(job.JobId)
+	} else {
+		p.fsClient.Cleanup(job.JobId, job.LocalFilePath)
+	}
+
+	job.Stage = StageFailed
+	if err := p.journal.Update(job.JournalEntry); err != nil {
+		log.Printf("Error journaling job %s: %v", job.JobId, err)
+	}
+	p.settle(job, false)
+}
+
+// settle acks or nacks every delivery of the job and lets the next job for the object start.
+func (p *Pipeline) settle(job *Job, succeeded bool) {
+	p.mu.Lock()
+	delete(p.inFlight, job.JobId)
+	handles := job.handles
+	p.mu.Unlock()
+
+	for _, handle := range handles {
+		if succeeded {
+			handle.Ack()
+		} else {
+			handle.Nack()
+		}
+	}
+	job.release()
+}
+
+func objectKey(message *subscribing.RomUploadedMessage) string {
+	if message.IsLocal() {
+		return message.LocalPath
+	}
+	return message.Bucket + "/" + message.File
+}
@@ -0,0 +1,198 @@
+package pipeline
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"rom-downloader/config"
+	"rom-downloader/persistence"
+	"rom-downloader/storage/local"
+	"rom-downloader/subscribing"
+	"testing"
+	"time"
+)
+
+// newDropFolderPipeline builds the pipeline the way main does for a drop folder
+// with local persistence, no GCP involved.
+func newDropFolderPipeline(t *testing.T) (*Pipeline, *config.LoaderConfig) {
+	t.Helper()
+
+	root := t.TempDir()
+	configuration := &config.LoaderConfig{
+		DeviceID:              "test-device",
+		TempFolder:            filepath.Join(root, "temp"),
+		DestinationFolderRoot: filepath.Join(root, "roms"),
+		RomTypeDestinations:   map[string]string{"SNES": "snes"},
+		MessageSource:         config.MessageSourceDropFolder,
+		DropFolder:            filepath.Join(root, "drop"),
+		Persistence:           config.PersistenceLocal,
+		LocalStoreFile:        filepath.Join(root, "temp", "downloads.json"),
+		ExtractionLimits: config.ExtractionLimits{
+			MaxTotalBytes:       1 << 30,
+			MaxEntries:          100,
+			MaxCompressionRatio: 1000,
+			MaxFileBytes:        1 << 30,
+		},
+		Concurrency: config.Concurrency{Download: 1, Install: 1, Persist: 1},
+		Retry:       config.RetryPolicy{MaxAttempts: 1, InitialDelayMs: 1, MaxDelayMs: 1, Multiplier: 1},
+	}
+	if err := os.MkdirAll(configuration.DropFolder, os.ModePerm); err != nil {
+		t.Fatalf("failed to create drop folder: %v", err)
+	}
+
+	journal, err := OpenJournal(configuration.TempFolder)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	t.Cleanup(func() { journal.Close() })
+
+	store, err := persistence.NewDownloadStore(context.Background(), configuration)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	fsClient := local.NewFsClient(configuration)
+	return NewPipeline(context.Background(), configuration, nil, fsClient, store, journal), configuration
+}
+
+// drop writes a zip archive with the given ROMs into the drop folder.
+func drop(t *testing.T, configuration *config.LoaderConfig, fileName string, roms map[string]string) string {
+	t.Helper()
+
+	filePath := filepath.Join(configuration.DropFolder, fileName)
+	file, err := os.Create(filePath)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", filePath, err)
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	for name, content := range roms {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatalf("failed to add %s: %v", name, err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+	return filePath
+}
+
+type settlement struct {
+	acked  bool
+	nacked bool
+}
+
+// runDropped processes the dropped file and returns how its message was settled.
+func runDropped(p *Pipeline, filePath string) *settlement {
+	settled := &settlement{}
+	message := subscribing.RomUploadedMessage{
+		MessageId: "drop-" + filepath.Base(filePath),
+		File:      filepath.Base(filePath),
+		Created:   time.Now().UTC(),
+		Updated:   time.Now().UTC(),
+		LocalPath: filePath,
+	}
+
+	messages := make(chan subscribing.ReceivedMessage, 1)
+	messages <- subscribing.NewReceivedMessage(message, func() { settled.acked = true }, func() { settled.nacked = true })
+	close(messages)
+
+	p.Run(messages)
+	return settled
+}
+
+func TestDroppedFileIsInstalled(t *testing.T) {
+	p, configuration := newDropFolderPipeline(t)
+	filePath := drop(t, configuration, "chrono_snes.zip", map[string]string{"Chrono Trigger.sfc": "rom content"})
+
+	settled := runDropped(p, filePath)
+
+	if !settled.acked || settled.nacked {
+		t.Fatalf("expected the message to be acked, got %+v", settled)
+	}
+
+	installedPath := filepath.Join(configuration.DestinationFolderRoot, "snes", "Chrono Trigger.sfc")
+	content, err := os.ReadFile(installedPath)
+	if err != nil {
+		t.Fatalf("expected %s to be installed: %v", installedPath, err)
+	}
+	if string(content) != "rom content" {
+		t.Errorf("unexpected content of %s: %q", installedPath, content)
+	}
+
+	if local.FileExists(filePath) {
+		t.Errorf("expected installed file %s to be removed from the drop folder", filePath)
+	}
+	if entry := p.journal.Get("drop-chrono_snes.zip"); entry == nil || entry.Stage != StageRecorded {
+		t.Errorf("expected the job to be journaled as recorded, got %+v", entry)
+	}
+}
+
+func TestFailedDroppedFileIsKept(t *testing.T) {
+	p, configuration := newDropFolderPipeline(t)
+	filePath := drop(t, configuration, "sonic_genesis.zip", map[string]string{"Sonic.md": "rom content"})
+
+	settled := runDropped(p, filePath)
+
+	if settled.acked || !settled.nacked {
+		t.Fatalf("expected the message to be nacked, got %+v", settled)
+	}
+
+	if local.FileExists(filePath) {
+		t.Errorf("expected %s to be moved out of the drop folder", filePath)
+	}
+	failedPath := filepath.Join(configuration.DropFolder, local.FailedFolderName, "sonic_genesis.zip")
+	if !local.FileExists(failedPath) {
+		t.Errorf("expected the dropped file to be kept in %s", failedPath)
+	}
+}
+
+func TestDroppedAgainFileIsInstalledAgain(t *testing.T) {
+	p, configuration := newDropFolderPipeline(t)
+	roms := map[string]string{"Chrono Trigger.sfc": "rom content"}
+	installedPath := filepath.Join(configuration.DestinationFolderRoot, "snes", "Chrono Trigger.sfc")
+
+	if settled := runDropped(p, drop(t, configuration, "chrono_snes.zip", roms)); !settled.acked {
+		t.Fatalf("expected the first drop to be acked, got %+v", settled)
+	}
+	if err := os.Remove(installedPath); err != nil {
+		t.Fatalf("failed to remove %s: %v", installedPath, err)
+	}
+
+	// Copies keeping the modification time get the same message ID
+	filePath := drop(t, configuration, "chrono_snes.zip", roms)
+	if settled := runDropped(p, filePath); !settled.acked || settled.nacked {
+		t.Fatalf("expected the second drop to be acked, got %+v", settled)
+	}
+
+	if !local.FileExists(installedPath) {
+		t.Errorf("expected %s to be installed again", installedPath)
+	}
+	if local.FileExists(filePath) {
+		t.Errorf("expected installed file %s to be removed from the drop folder", filePath)
+	}
+}
+
+func TestNotRecognizedDroppedFileIsKept(t *testing.T) {
+	p, configuration := newDropFolderPipeline(t)
+	filePath := filepath.Join(configuration.DropFolder, "Some Game.bin")
+	if err := os.WriteFile(filePath, []byte("unknown content"), 0644); err != nil {
+		t.Fatalf("failed to create %s: %v", filePath, err)
+	}
+
+	settled := runDropped(p, filePath)
+
+	if settled.acked || !settled.nacked {
+		t.Fatalf("expected the message to be nacked, got %+v", settled)
+	}
+	failedPath := filepath.Join(configuration.DropFolder, local.FailedFolderName, "Some Game.bin")
+	if !local.FileExists(failedPath) {
+		t.Errorf("expected the not recognized file to be kept in %s", failedPath)
+	}
+}
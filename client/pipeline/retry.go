@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"rom-downloader/config"
+	"rom-downloader/storage/gcs"
+	"rom-downloader/storage/local"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error classes, failures of the retryable one are worth another attempt
+const (
+	ErrorClassRetryable = "retryable"
+	ErrorClassPermanent = "permanent"
+)
+
+// retry runs the step until it succeeds, fails permanently or runs out of
+// attempts. Returns the number of attempts made.
+func (p *Pipeline) retry(job *Job, stage string, step func() error) (int, error) {
+	policy := p.config.Retry
+	for attempt := 1; ; attempt++ {
+		err := step()
+		if err == nil {
+			return attempt, nil
+		}
+
+		if classifyError(err) == ErrorClassPermanent || attempt >= policy.MaxAttempts || p.ctx.Err() != nil {
+			return attempt, err
+		}
+
+		delay := backoffDelay(policy, attempt)
+		log.Printf("Attempt %d of %s for %s failed, retrying in %s: %v", attempt, stage, job.Message.File, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-p.ctx.Done():
+			return attempt, err
+		}
+	}
+}
+
+// backoffDelay grows the delay exponentially and keeps a random half of it, so
+// failures hitting several jobs at once do not retry in lockstep.
+func backoffDelay(policy config.RetryPolicy, attempt int) time.Duration {
+	delay := float64(policy.InitialDelayMs) * math.Pow(policy.Multiplier, float64(attempt-1))
+	delay = math.Min(delay, float64(policy.MaxDelayMs))
+
+	jittered := delay/2 + rand.Float64()*delay/2
+	return time.Duration(jittered) * time.Millisecond
+}
+
+// classifyError tells transient failures (network, GCS 5xx, Firestore unavailable,
+// corrupted download) from ones that would fail the same way again.
+func classifyError(err error) string {
+	var checksumMismatch *gcs.ChecksumMismatchError
+	var extractionLimit *local.ExtractionLimitError
+	var googleApiError *googleapi.Error
+	var netError net.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorClassPermanent
+	case errors.Is(err, storage.ErrObjectNotExist), errors.Is(err, storage.ErrBucketNotExist):
+		return ErrorClassPermanent
+	case errors.As(err, &extractionLimit),
+		errors.Is(err, local.ErrInvalidFileName),
+		errors.Is(err, local.ErrUnsupportedArchive),
+		errors.Is(err, local.ErrIllegalPath),
+		errors.Is(err, local.ErrRomTypeNotConfigured),
+		errors.Is(err, local.ErrRomTypeNotRecognized),
+		errors.Is(err, os.ErrNotExist):
+		return ErrorClassPermanent
+	case errors.As(err, &checksumMismatch):
+		// The corrupted file is gone, the next attempt downloads it again
+		return ErrorClassRetryable
+	case errors.As(err, &googleApiError):
+		if googleApiError.Code == http.StatusTooManyRequests || googleApiError.Code >= http.StatusInternalServerError {
+			return ErrorClassRetryable
+		}
+		return ErrorClassPermanent
+	case errors.As(err, &netError),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassRetryable
+	}
+
+	if grpcStatus, ok := status.FromError(err); ok {
+		switch grpcStatus.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+			return ErrorClassRetryable
+		case codes.Unknown:
+			// Not a gRPC error at all, see below
+		default:
+			return ErrorClassPermanent
+		}
+	}
+
+	// Everything else is mostly local disk trouble (full SD card, busy USB drive), worth another try
+	return ErrorClassRetryable
+}
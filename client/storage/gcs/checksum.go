@@ -0,0 +1,121 @@
+package gcs
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"rom-downloader/storage/local"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const checksumMismatchesFileName = "checksum-mismatches.jsonl"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumMismatchError means the downloaded bytes differ from the object in the bucket.
+type ChecksumMismatchError struct {
+	Bucket     string `json:"bucket"`
+	Object     string `json:"object"`
+	Generation int64  `json:"generation"`
+	Algorithm  string `json:"algorithm"`
+	Expected   string `json:"expected"`
+	Actual     string `json:"actual"`
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf(
+		"%s checksum mismatch for %s/%s (generation %d): expected %s, got %s",
+		e.Algorithm, e.Bucket, e.Object, e.Generation, e.Expected, e.Actual)
+}
+
+// objectHasher computes the checksums GCS keeps for objects while the bytes are streamed.
+type objectHasher struct {
+	crc32c hash.Hash32
+	md5    hash.Hash
+}
+
+func newObjectHasher() *objectHasher {
+	return &objectHasher{
+		crc32c: crc32.New(crc32cTable),
+		md5:    md5.New(),
+	}
+}
+
+func (h *objectHasher) Write(p []byte) (int, error) {
+	h.crc32c.Write(p)
+	h.md5.Write(p)
+	return len(p), nil
+}
+
+// hashFile feeds an already downloaded part into the hasher, so resumed downloads are verified in full.
+func (h *objectHasher) hashFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(h, file)
+	return err
+}
+
+func (h *objectHasher) verify(attrs *storage.ObjectAttrs) error {
+	actualCrc32c := h.crc32c.Sum32()
+	if actualCrc32c != attrs.CRC32C {
+		return &ChecksumMismatchError{
+			Bucket:     attrs.Bucket,
+			Object:     attrs.Name,
+			Generation: attrs.Generation,
+			Algorithm:  "CRC32C",
+			Expected:   encodeCrc32c(attrs.CRC32C),
+			Actual:     encodeCrc32c(actualCrc32c),
+		}
+	}
+
+	// Composite objects have no MD5
+	if len(attrs.MD5) == 0 {
+		return nil
+	}
+
+	actualMd5 := h.md5.Sum(nil)
+	if string(actualMd5) != string(attrs.MD5) {
+		return &ChecksumMismatchError{
+			Bucket:     attrs.Bucket,
+			Object:     attrs.Name,
+			Generation: attrs.Generation,
+			Algorithm:  "MD5",
+			Expected:   base64.StdEncoding.EncodeToString(attrs.MD5),
+			Actual:     base64.StdEncoding.EncodeToString(actualMd5),
+		}
+	}
+	return nil
+}
+
+// encodeCrc32c formats the checksum the same way GCS shows it (base64 of big-endian bytes).
+func encodeCrc32c(checksum uint32) string {
+	bytes := []byte{byte(checksum >> 24), byte(checksum >> 16), byte(checksum >> 8), byte(checksum)}
+	return base64.StdEncoding.EncodeToString(bytes)
+}
+
+// recordChecksumMismatch keeps a local trail of corrupted downloads next to the temp files.
+func (g *Client) recordChecksumMismatch(mismatch *ChecksumMismatchError) {
+	log.Printf("Checksum mismatch: %v", mismatch)
+
+	record := struct {
+		*ChecksumMismatchError
+		DetectedAt time.Time `json:"detectedAt"`
+	}{mismatch, time.Now().UTC()}
+
+	recordPath := filepath.Join(g.config.TempFolder, checksumMismatchesFileName)
+	if err := local.AppendJSONLine(recordPath, record); err != nil {
+		log.Printf("Error writing checksum mismatch: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package gcs
 import (
 	"cloud.google.com/go/storage"
 	"context"
+	"errors"
 	"fmt"
 	"google.golang.org/api/option"
 	"io"
@@ -12,6 +13,8 @@ import (
 	"rom-downloader/config"
 	"rom-downloader/storage/local"
 	"rom-downloader/subscribing"
+	"strings"
+	"time"
 )
 
 type Client struct {
@@ -33,51 +36,207 @@ func NewGcsClient(ctx context.Context, config *config.LoaderConfig) *Client {
 	}
 }
 
-func (g *Client) DownloadFile(message *subscribing.RomUploadedMessage) (string, error) {
+// DownloadResult describes the downloaded object.
+type DownloadResult struct {
+	FilePath   string
+	Generation int64
+	Size       int64
+	Duration   time.Duration
+}
+
+func (g *Client) DownloadFile(message *subscribing.RomUploadedMessage) (*DownloadResult, error) {
+	startedAt := time.Now()
 	fileName := message.File
 	destinationFilePath := filepath.Join(g.config.TempFolder, fileName)
+
+	bucket := g.storageClient.Bucket(message.Bucket)
+	attrs, err := bucket.Object(fileName).Attrs(g.context)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attributes of file %s: %w", fileName, err)
+	}
+
+	result := &DownloadResult{FilePath: destinationFilePath, Generation: attrs.Generation, Size: attrs.Size}
 	if local.FileExists(destinationFilePath) {
-		log.Printf("File %s already exists, skipping download", destinationFilePath)
-		return destinationFilePath, nil
+		// Left behind by a crash after the rename, possibly of an older generation
+		err := verifyFile(destinationFilePath, attrs)
+		if err == nil {
+			log.Printf("File %s already exists, skipping download", destinationFilePath)
+			setUploadTime(destinationFilePath, attrs)
+			result.Duration = time.Since(startedAt)
+			return result, nil
+		}
+
+		log.Printf("Existing file %s does not match generation %d, downloading it again: %v", destinationFilePath, attrs.Generation, err)
+		if err := os.Remove(destinationFilePath); err != nil {
+			return nil, fmt.Errorf("failed to remove outdated file %s: %w", destinationFilePath, err)
+		}
 	}
 
 	destinationDir := filepath.Dir(destinationFilePath)
 	if err := os.MkdirAll(destinationDir, os.ModePerm); err != nil {
-		return "", fmt.Errorf("failed to create directory %s: %w", destinationDir, err)
+		return nil, fmt.Errorf("failed to create directory %s: %w", destinationDir, err)
 	}
 
-	bucket := g.storageClient.Bucket(message.Bucket)
-	obj := bucket.Object(fileName)
+	// Pin every read to the generation, a re-upload must not be appended to an older part
+	obj := bucket.Object(fileName).Generation(attrs.Generation)
+	partFilePath := getPartFilePath(destinationFilePath, attrs.Generation)
+	removeStalePartFiles(destinationFilePath, partFilePath)
+
+	hasher := newObjectHasher()
+	written, err := g.downloadToPartFile(obj, partFilePath, attrs.Size, hasher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file %s: %w", fileName, err)
+	}
+
+	if written != attrs.Size {
+		return nil, fmt.Errorf("incomplete download of file %s: got %d of %d bytes", fileName, written, attrs.Size)
+	}
 
-	destinationFile, err := os.Create(destinationFilePath)
+	if err := hasher.verify(attrs); err != nil {
+		var mismatch *ChecksumMismatchError
+		if errors.As(err, &mismatch) {
+			g.recordChecksumMismatch(mismatch)
+		}
+		if removeErr := os.Remove(partFilePath); removeErr != nil {
+			log.Printf("Error removing corrupted part file %s: %v", partFilePath, removeErr)
+		}
+		return nil, err
+	}
+
+	setUploadTime(partFilePath, attrs)
+	if err := os.Rename(partFilePath, destinationFilePath); err != nil {
+		return nil, fmt.Errorf("failed to rename part file %s: %w", partFilePath, err)
+	}
+
+	log.Printf("Successfully downloaded %d bytes for file %s", written, fileName)
+
+	result.Duration = time.Since(startedAt)
+	return result, nil
+}
+
+// setUploadTime dates the file to the upload of the object, like extracted
+// archive members are dated to their archive entry, so keepNewer compares
+// uploads instead of download times.
+func setUploadTime(filePath string, attrs *storage.ObjectAttrs) {
+	if attrs.Created.IsZero() {
+		return
+	}
+	if err := os.Chtimes(filePath, attrs.Created, attrs.Created); err != nil {
+		log.Printf("Error setting modification time of %s: %v", filePath, err)
+	}
+}
+
+// verifyFile checks the file has the size and checksums of the object generation.
+func verifyFile(filePath string, attrs *storage.ObjectAttrs) error {
+	info, err := os.Stat(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create destination file %s: %w", destinationFilePath, err)
+		return err
+	}
+	if info.Size() != attrs.Size {
+		return fmt.Errorf("size %d differs from object size %d", info.Size(), attrs.Size)
+	}
+
+	hasher := newObjectHasher()
+	if err := hasher.hashFile(filePath); err != nil {
+		return fmt.Errorf("failed to hash file %s: %w", filePath, err)
+	}
+	return hasher.verify(attrs)
+}
+
+// downloadToPartFile continues the download where a previous attempt ended and
+// returns the total size of the part file. All of its bytes end up in the hasher.
+func (g *Client) downloadToPartFile(
+	obj *storage.ObjectHandle,
+	partFilePath string,
+	objectSize int64,
+	hasher *objectHasher,
+) (int64, error) {
+	var offset int64
+	if info, err := os.Stat(partFilePath); err == nil {
+		offset = info.Size()
+	}
+
+	if offset > objectSize {
+		log.Printf("Part file %s is bigger than the object, starting over", partFilePath)
+		if err := os.Remove(partFilePath); err != nil {
+			return 0, fmt.Errorf("failed to remove part file %s: %w", partFilePath, err)
+		}
+		offset = 0
+	}
+
+	if offset > 0 {
+		if err := hasher.hashFile(partFilePath); err != nil {
+			return 0, fmt.Errorf("failed to hash part file %s: %w", partFilePath, err)
+		}
+	}
+
+	if offset == objectSize {
+		return offset, nil
+	}
+
+	if offset > 0 {
+		log.Printf("Resuming download of %s from byte %d", obj.ObjectName(), offset)
 	}
 
+	partFile, err := os.OpenFile(partFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return offset, fmt.Errorf("failed to open part file %s: %w", partFilePath, err)
+	}
 	defer func() {
-		if err := destinationFile.Close(); err != nil {
-			log.Printf("Error closing destination file %s: %v", destinationFilePath, err)
+		if err := partFile.Close(); err != nil {
+			log.Printf("Error closing part file %s: %v", partFilePath, err)
 		}
 	}()
 
-	reader, err := obj.NewReader(g.context)
+	reader, err := obj.NewRangeReader(g.context, offset, -1)
 	if err != nil {
-		return "", fmt.Errorf("failed to create reader for file %s: %w", fileName, err)
+		return offset, fmt.Errorf("failed to create reader: %w", err)
 	}
 	defer func() {
 		if err := reader.Close(); err != nil {
-			log.Printf("Error closing reader for file %s: %v", fileName, err)
+			log.Printf("Error closing reader for file %s: %v", obj.ObjectName(), err)
 		}
 	}()
 
-	copied, err := g.copyWithCancellation(destinationFile, reader)
+	copied, err := g.copyWithCancellation(io.MultiWriter(partFile, hasher), reader)
+	if err != nil {
+		return offset + copied, fmt.Errorf("failed to copy: %w", err)
+	}
+
+	// The part file gets renamed next, make sure its content survives a power loss
+	if err := partFile.Sync(); err != nil {
+		return offset + copied, fmt.Errorf("failed to sync part file %s: %w", partFilePath, err)
+	}
+
+	return offset + copied, nil
+}
+
+func getPartFilePath(destinationFilePath string, generation int64) string {
+	return fmt.Sprintf("%s.%d.part", destinationFilePath, generation)
+}
+
+// removeStalePartFiles deletes parts left behind by other generations of the object.
+func removeStalePartFiles(destinationFilePath string, currentPartFilePath string) {
+	entries, err := os.ReadDir(filepath.Dir(destinationFilePath))
 	if err != nil {
-		return "", fmt.Errorf("failed to copy file %s: %w", fileName, err)
+		return
 	}
 
-	log.Printf("Successfully copied %d bytes for file %s", copied, fileName)
+	prefix := filepath.Base(destinationFilePath) + "."
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".part") {
+			continue
+		}
 
-	return destinationFilePath, nil
+		partFile := filepath.Join(filepath.Dir(destinationFilePath), name)
+		if partFile == currentPartFilePath {
+			continue
+		}
+		if err := os.Remove(partFile); err != nil {
+			log.Printf("Error removing stale part file %s: %v", partFile, err)
+		}
+	}
 }
 
 func (g *Client) copyWithCancellation(dst io.Writer, src io.Reader) (int64, error) {
@@ -119,6 +278,15 @@ func (g *Client) copyWithCancellation(dst io.Writer, src io.Reader) (int64, erro
 	return written, nil
 }
 
+// GetGeneration returns the current generation of the object the message is about.
+func (g *Client) GetGeneration(message *subscribing.RomUploadedMessage) (int64, error) {
+	attrs, err := g.storageClient.Bucket(message.Bucket).Object(message.File).Attrs(g.context)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get attributes of file %s: %w", message.File, err)
+	}
+	return attrs.Generation, nil
+}
+
 func (g *Client) Close() error {
 	return g.storageClient.Close()
 }
@@ -0,0 +1,65 @@
+package gcs
+
+import (
+	"crypto/md5"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func objectAttrs(content string, generation int64) *storage.ObjectAttrs {
+	md5Sum := md5.Sum([]byte(content))
+	return &storage.ObjectAttrs{
+		Bucket:     "roms",
+		Name:       "game_snes.zip",
+		Generation: generation,
+		Size:       int64(len(content)),
+		CRC32C:     crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli)),
+		MD5:        md5Sum[:],
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "game_snes.zip")
+	if err := os.WriteFile(filePath, []byte("first upload"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	if err := verifyFile(filePath, objectAttrs("first upload", 1)); err != nil {
+		t.Errorf("expected the file to match its generation, got %v", err)
+	}
+
+	// A file left behind by an older generation must not pass as the newer one
+	var mismatch *ChecksumMismatchError
+	if err := verifyFile(filePath, objectAttrs("other upload", 2)); !errors.As(err, &mismatch) {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+	if err := verifyFile(filePath, objectAttrs("a longer second upload", 2)); err == nil {
+		t.Error("expected a size mismatch")
+	}
+}
+
+func TestSetUploadTime(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "game_snes.sfc")
+	if err := os.WriteFile(filePath, []byte("rom"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	// keepNewer compares modification times, a download must not look newer than its upload
+	attrs := objectAttrs("rom", 1)
+	attrs.Created = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	setUploadTime(filePath, attrs)
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+	if !info.ModTime().Equal(attrs.Created) {
+		t.Errorf("expected modification time %s, got %s", attrs.Created, info.ModTime())
+	}
+}
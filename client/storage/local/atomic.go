@@ -0,0 +1,54 @@
+package local
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic replaces the file with what write produces. The content goes
+// to a temp file that is synced and renamed over the file, so a power loss
+// leaves either the old or the new content.
+func WriteFileAtomic(path string, write func(io.Writer) error) error {
+	tempPath := path + ".tmp"
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tempPath, err)
+	}
+
+	if err := writeAndClose(tempFile, write); err != nil {
+		if removeErr := os.Remove(tempPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Printf("Error removing temp file %s: %v", tempPath, removeErr)
+		}
+		return fmt.Errorf("failed to write %s: %w", tempPath, err)
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		log.Printf("Error syncing folder %s: %v", filepath.Dir(path), err)
+	}
+	return nil
+}
+
+func writeAndClose(tempFile *os.File, write func(io.Writer) error) error {
+	buffered := bufio.NewWriter(tempFile)
+	if err := write(buffered); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	return tempFile.Close()
+}
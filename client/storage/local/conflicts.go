@@ -0,0 +1,168 @@
+package local
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"rom-downloader/config"
+	"strings"
+)
+
+// Outcome of installing one file into its console folder
+const (
+	DecisionInstalled   = "installed"
+	DecisionOverwritten = "overwritten"
+	DecisionSkipped     = "skipped"
+	DecisionRenamed     = "renamed"
+)
+
+const maxRenameSuffix = 1000
+
+type InstalledFile struct {
+	SourcePath      string
+	DestinationPath string
+	RomType         string
+	Conflict        bool   // A file with the same name was already installed
+	Policy          string // Collision policy applied when Conflict is set
+	Decision        string
+	Size            int64
+	Sha1            string
+	Crc32           string
+}
+
+type ProcessResult struct {
+	Files []InstalledFile
+}
+
+// pendingFiles returns the files the result does not cover yet.
+func (r *ProcessResult) pendingFiles(filePaths []string) []string {
+	handled := make(map[string]struct{}, len(r.Files))
+	for _, file := range r.Files {
+		handled[file.SourcePath] = struct{}{}
+	}
+
+	var pending []string
+	for _, filePath := range filePaths {
+		if _, exists := handled[filePath]; !exists {
+			pending = append(pending, filePath)
+		}
+	}
+	return pending
+}
+
+// resolveConflict decides where the file goes when the destination is taken,
+// an empty path means the file should not be installed.
+func resolveConflict(sourcePath string, destinationPath string, policy string) (string, string, error) {
+	existing, err := os.Stat(destinationPath)
+	if os.IsNotExist(err) {
+		return destinationPath, DecisionInstalled, nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to stat %s: %w", destinationPath, err)
+	}
+
+	switch policy {
+	case config.ConflictSkip:
+		return "", DecisionSkipped, nil
+	case config.ConflictRename:
+		renamedPath, err := nextFreePath(destinationPath)
+		if err != nil {
+			return "", "", err
+		}
+		return renamedPath, DecisionRenamed, nil
+	case config.ConflictKeepNewer:
+		incoming, err := os.Stat(sourcePath)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to stat %s: %w", sourcePath, err)
+		}
+		if !incoming.ModTime().After(existing.ModTime()) {
+			return "", DecisionSkipped, nil
+		}
+		return destinationPath, DecisionOverwritten, nil
+	case config.ConflictSkipIdentical:
+		identical, err := filesIdentical(sourcePath, destinationPath)
+		if err != nil {
+			return "", "", err
+		}
+		if identical {
+			return "", DecisionSkipped, nil
+		}
+		return destinationPath, DecisionOverwritten, nil
+	default:
+		return destinationPath, DecisionOverwritten, nil
+	}
+}
+
+// nextFreePath appends a numeric suffix, "game.nes" becomes "game (1).nes".
+func nextFreePath(filePath string) (string, error) {
+	extension := filepath.Ext(filePath)
+	base := strings.TrimSuffix(filePath, extension)
+	for i := 1; i <= maxRenameSuffix; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, extension)
+		if !FileExists(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free name found for %s", filePath)
+}
+
+func filesIdentical(firstPath string, secondPath string) (bool, error) {
+	firstInfo, err := os.Stat(firstPath)
+	if err != nil {
+		return false, err
+	}
+	secondInfo, err := os.Stat(secondPath)
+	if err != nil {
+		return false, err
+	}
+	if firstInfo.Size() != secondInfo.Size() {
+		return false, nil
+	}
+
+	firstHash, err := hashFileSha1(firstPath)
+	if err != nil {
+		return false, err
+	}
+	secondHash, err := hashFileSha1(secondPath)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(firstHash, secondHash), nil
+}
+
+func hashFileSha1(filePath string) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %w", filePath, err)
+	}
+	return hash.Sum(nil), nil
+}
+
+// digestFile returns the size and the hex encoded SHA-1 and CRC32 of the file,
+// the hashes ROM sets are usually verified against.
+func digestFile(filePath string) (int64, string, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", "", fmt.Errorf("failed to open %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	sha1Hash := sha1.New()
+	crc32Hash := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(sha1Hash, crc32Hash), file)
+	if err != nil {
+		return 0, "", "", fmt.Errorf("failed to hash %s: %w", filePath, err)
+	}
+	return size, hex.EncodeToString(sha1Hash.Sum(nil)), hex.EncodeToString(crc32Hash.Sum(nil)), nil
+}
@@ -0,0 +1,233 @@
+package local
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Rom types detected from file content, they match keys of RomTypeDestinations
+const (
+	romTypeNES  = "NES"
+	romTypeSNES = "SNES"
+	romTypeN64  = "N64"
+	romTypeGB   = "GB"
+	romTypeGBC  = "GBC"
+	romTypeGBA  = "GBA"
+)
+
+var romTypesByExtension = map[string]string{
+	".nes": romTypeNES,
+	".sfc": romTypeSNES,
+	".smc": romTypeSNES,
+	".z64": romTypeN64,
+	".n64": romTypeN64,
+	".v64": romTypeN64,
+	".gb":  romTypeGB,
+	".gbc": romTypeGBC,
+	".gba": romTypeGBA,
+}
+
+var (
+	inesMagic = []byte{'N', 'E', 'S', 0x1A}
+
+	// N64 magic in big-endian (z64), byte-swapped (v64) and little-endian (n64) order
+	n64Magics = [][]byte{
+		{0x80, 0x37, 0x12, 0x40},
+		{0x37, 0x80, 0x40, 0x12},
+		{0x40, 0x12, 0x37, 0x80},
+	}
+
+	gameBoyLogo = []byte{
+		0xCE, 0xED, 0x66, 0x66, 0xCC, 0x0D, 0x00, 0x0B, 0x03, 0x73, 0x00, 0x83,
+		0x00, 0x0C, 0x00, 0x0D, 0x00, 0x08, 0x11, 0x1F, 0x88, 0x89, 0x00, 0x0E,
+		0xDC, 0xCC, 0x6E, 0xE6, 0xDD, 0xDD, 0xD9, 0x99, 0xBB, 0xBB, 0x67, 0x63,
+		0x6E, 0x0E, 0xEC, 0xCC, 0xDD, 0xDC, 0x99, 0x9F, 0xBB, 0xB9, 0x33, 0x3E,
+	}
+)
+
+const (
+	gameBoyLogoOffset    = 0x104
+	gameBoyCgbFlagOffset = 0x143
+
+	gbaFixedValueOffset = 0xB2
+	gbaFixedValue       = 0x96
+	gbaChecksumOffset   = 0xBD
+
+	snesCopierHeaderSize = 512
+	snesHeaderSize       = 0x40
+	snesMinScore         = 6
+)
+
+// Internal header locations for LoROM, HiROM and ExHiROM cartridges
+var snesHeaderOffsets = []int64{0x7FC0, 0xFFC0, 0x40FFC0}
+
+// detectRomType recognizes the console of a ROM from its header, falling back
+// to well known file extensions. Returns an empty string when nothing matches.
+func detectRomType(filePath string) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return ""
+	}
+
+	detectors := []func(io.ReaderAt, int64) string{
+		detectNES,
+		detectN64,
+		detectGameBoy,
+		detectGBA,
+		detectSNES,
+	}
+	for _, detect := range detectors {
+		if romType := detect(file, info.Size()); romType != "" {
+			return romType
+		}
+	}
+
+	return romTypesByExtension[strings.ToLower(filepath.Ext(filePath))]
+}
+
+func detectNES(reader io.ReaderAt, _ int64) string {
+	// iNES and NES 2.0 share the magic, NES 2.0 only adds flags in byte 7
+	header, ok := readAt(reader, 0, 16)
+	if !ok || !bytes.Equal(header[:4], inesMagic) {
+		return ""
+	}
+	return romTypeNES
+}
+
+func detectN64(reader io.ReaderAt, _ int64) string {
+	magic, ok := readAt(reader, 0, 4)
+	if !ok {
+		return ""
+	}
+
+	for _, n64Magic := range n64Magics {
+		if bytes.Equal(magic, n64Magic) {
+			return romTypeN64
+		}
+	}
+	return ""
+}
+
+func detectGameBoy(reader io.ReaderAt, _ int64) string {
+	logo, ok := readAt(reader, gameBoyLogoOffset, int64(len(gameBoyLogo)))
+	if !ok || !bytes.Equal(logo, gameBoyLogo) {
+		return ""
+	}
+
+	cgbFlag, ok := readAt(reader, gameBoyCgbFlagOffset, 1)
+	if !ok {
+		return ""
+	}
+
+	// 0x80 marks games enhanced for the Color, 0xC0 games that only run on it
+	if cgbFlag[0] == 0x80 || cgbFlag[0] == 0xC0 {
+		return romTypeGBC
+	}
+	return romTypeGB
+}
+
+func detectGBA(reader io.ReaderAt, _ int64) string {
+	header, ok := readAt(reader, 0, gbaChecksumOffset+1)
+	if !ok || header[gbaFixedValueOffset] != gbaFixedValue {
+		return ""
+	}
+
+	// Header complement check over the title, game code and maker code
+	var checksum byte
+	for _, value := range header[0xA0:gbaChecksumOffset] {
+		checksum -= value
+	}
+	checksum -= 0x19
+
+	if checksum != header[gbaChecksumOffset] {
+		return ""
+	}
+	return romTypeGBA
+}
+
+func detectSNES(reader io.ReaderAt, size int64) string {
+	// Dumps made with copier devices carry an extra 512 byte header
+	var copierOffset int64
+	if size%1024 == snesCopierHeaderSize {
+		copierOffset = snesCopierHeaderSize
+	}
+
+	bestScore := 0
+	for _, headerOffset := range snesHeaderOffsets {
+		header, ok := readAt(reader, copierOffset+headerOffset, snesHeaderSize)
+		if !ok {
+			continue
+		}
+
+		if score := scoreSnesHeader(header, headerOffset); score > bestScore {
+			bestScore = score
+		}
+	}
+
+	if bestScore < snesMinScore {
+		return ""
+	}
+	return romTypeSNES
+}
+
+// scoreSnesHeader rates how much the bytes look like a real SNES internal header.
+func scoreSnesHeader(header []byte, headerOffset int64) int {
+	score := 0
+
+	checksumComplement := uint16(header[0x1C]) | uint16(header[0x1D])<<8
+	checksum := uint16(header[0x1E]) | uint16(header[0x1F])<<8
+	if checksum+checksumComplement == 0xFFFF {
+		score += 4
+	}
+
+	mapMode := header[0x15] &^ 0x10
+	switch {
+	case headerOffset == 0x7FC0 && (mapMode == 0x20 || mapMode == 0x22 || mapMode == 0x23):
+		score += 2
+	case headerOffset == 0xFFC0 && mapMode == 0x21:
+		score += 2
+	case headerOffset == 0x40FFC0 && mapMode == 0x25:
+		score += 2
+	}
+
+	romSize := header[0x17]
+	if romSize >= 0x07 && romSize <= 0x0D {
+		score++
+	}
+
+	printable := 0
+	for _, character := range header[:21] {
+		if character >= 0x20 && character <= 0x7E {
+			printable++
+		}
+	}
+	if printable == 21 {
+		score += 2
+	}
+
+	// Emulation reset vector has to point into ROM
+	resetVector := uint16(header[0x3C]) | uint16(header[0x3D])<<8
+	if resetVector >= 0x8000 {
+		score++
+	}
+
+	return score
+}
+
+func readAt(reader io.ReaderAt, offset int64, length int64) ([]byte, bool) {
+	buffer := make([]byte, length)
+	read, err := reader.ReadAt(buffer, offset)
+	if int64(read) != length || (err != nil && err != io.EOF) {
+		return nil, false
+	}
+	return buffer, true
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package local
+
+func FreeSpace(_ string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
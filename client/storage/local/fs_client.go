@@ -4,99 +4,304 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
+	"regexp"
 	"rom-downloader/config"
+	"time"
 )
 
 type FsClient struct {
 	config *config.LoaderConfig
 }
 
+const (
+	jobsFolderName   = "jobs"
+	extractedDirName = "extracted"
+
+	// Dropped files that could not be installed are set aside here, next to the drop folder files
+	FailedFolderName = "failed"
+)
+
+// Steps of installing a file, reported by StageError
+const (
+	StageRoute = "route" // Picking the console folder
+	StageMove  = "move"  // Moving the file into it
+)
+
+// StageError tells which step of installing a file failed.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+var unsafeJobIdCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
 func NewFsClient(config *config.LoaderConfig) *FsClient {
 	return &FsClient{config: config}
 }
 
-func (c *FsClient) ProcessLocalFile(filePath string) error {
+// ExtractResult lists the files a job is going to install.
+type ExtractResult struct {
+	SourcePath string
+	RomType    string // Tag from the file name, empty when the console is detected from content
+	Files      []string
+	Archive    bool
+	Duration   time.Duration
+}
+
+// Extract unpacks the file into the job directory when it is an archive. It
+// can be repeated, the caller cleans the job up once it is done with it.
+func (c *FsClient) Extract(jobId string, filePath string) (*ExtractResult, error) {
+	startedAt := time.Now()
 	if !FileExists(filePath) {
-		return fmt.Errorf("file %s does not exist, skipping processing", filePath)
+		return nil, fmt.Errorf("file %s does not exist, skipping processing: %w", filePath, os.ErrNotExist)
+	}
+
+	if jobId == "" {
+		return nil, fmt.Errorf("missing job id for file %s", filePath)
 	}
 
 	extensions, err := getFileExtensions(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	filesToRemove := &[]string{filePath}
-	defer func() {
-		err = removeFiles(*filesToRemove)
-		if err != nil {
-			log.Printf("Error removing files: %v", err)
+	extracted := &ExtractResult{SourcePath: filePath, Files: []string{filePath}}
+
+	// Tagged files go to the tagged console, fail early when it is not configured
+	if extensions.CustomExtension != nil {
+		extracted.RomType = *extensions.CustomExtension
+		if _, err = c.getConsoleFolder(extracted.RomType); err != nil {
+			return nil, &StageError{Stage: StageRoute, Err: err}
 		}
-	}()
+	}
+
+	if !fileIsArchive(filePath) {
+		log.Printf("File %s is not an archive, skipping extraction\n", filePath)
+		extracted.Duration = time.Since(startedAt)
+		return extracted, nil
+	}
+
+	requiredBytes := estimateUncompressedSize(filePath)
+	err = checkFreeSpace(requiredBytes, c.config.ExtractionLimits, c.config.TempFolder, c.config.DestinationFolderRoot)
+	if err != nil {
+		return nil, err
+	}
 
-	// We just want not tagged files let be
-	if extensions.CustomExtension == nil {
-		log.Printf("File %s is not tagged, skipping processing\n", filePath)
-		return nil
+	// Start from a clean folder, a previous attempt may have left partial files
+	extractedPath := filepath.Join(c.getJobDir(jobId), extractedDirName)
+	if err = os.RemoveAll(extractedPath); err != nil {
+		return nil, fmt.Errorf("failed to clean extraction directory %s: %w", extractedPath, err)
 	}
 
-	consoleFolder, err := c.getConsoleFolder(extensions)
+	extracted.Files, err = ExtractArchive(filePath, extractedPath, c.config.ExtractionLimits)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	extracted.Archive = true
+	extracted.Duration = time.Since(startedAt)
+	return extracted, nil
+}
 
-	if !fileIsArchive(filePath) {
-		log.Printf("File %s is not an archive, skipping extraction\n", filePath)
-		err = sortFilesToFolders([]string{filePath}, consoleFolder)
+// Install moves the extracted files to their console folders. Files already
+// installed by a previous attempt are taken over from its result.
+func (c *FsClient) Install(extracted *ExtractResult, previous *ProcessResult) (*ProcessResult, error) {
+	result := &ProcessResult{}
+	pendingFiles := extracted.Files
+	if previous != nil {
+		result.Files = append(result.Files, previous.Files...)
+		pendingFiles = previous.pendingFiles(extracted.Files)
+	}
+
+	if extracted.RomType != "" {
+		err := c.sortFilesToFolders(pendingFiles, extracted.RomType, result)
+		return result, err
+	}
+
+	filesByRomType := c.groupByDetectedConsole(pendingFiles)
+	if len(filesByRomType) == 0 {
+		// We just want not tagged and not recognized files let be
+		log.Printf("File %s is not tagged and its console was not recognized, skipping processing\n", extracted.SourcePath)
+		return result, nil
+	}
+
+	for romType, romFiles := range filesByRomType {
+		err := c.sortFilesToFolders(romFiles, romType, result)
 		if err != nil {
-			return err
+			return result, err
 		}
-		log.Printf("File was moved to %s\n", consoleFolder)
-		return nil
 	}
+	return result, nil
+}
 
-	extractedPath := path.Join(c.config.TempFolder, "extracted")
-	filePaths, err := ExtractArchive(filePath, extractedPath)
-	*filesToRemove = append(*filesToRemove, filePaths...)
+// Cleanup removes the source file and the whole working directory of the job.
+func (c *FsClient) Cleanup(jobId string, sourcePath string) {
+	if err := removeFiles([]string{sourcePath}); err != nil {
+		log.Printf("Error removing files: %v", err)
+	}
+	c.CleanupJob(jobId)
+}
 
-	if err != nil {
-		return err
+// CleanupJob removes the working directory of the job and keeps the source file.
+func (c *FsClient) CleanupJob(jobId string) {
+	jobDir := c.getJobDir(jobId)
+	if err := os.RemoveAll(jobDir); err != nil {
+		log.Printf("Error removing job directory %s: %v", jobDir, err)
 	}
-	err = sortFilesToFolders(filePaths, consoleFolder)
-	if err != nil {
-		return err
+}
+
+// SetAsideFailed moves a dropped file that could not be installed into the
+// failed folder next to it and returns its new path. It is the only copy of
+// the ROM, so it is never removed.
+func (c *FsClient) SetAsideFailed(jobId string, filePath string) (string, error) {
+	failedDir := filepath.Join(filepath.Dir(filePath), FailedFolderName)
+	if err := os.MkdirAll(failedDir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", failedDir, err)
 	}
-	return nil
+
+	// Never overwrite an earlier failed file of the same name
+	failedPath := filepath.Join(failedDir, filepath.Base(filePath))
+	if FileExists(failedPath) {
+		failedPath = filepath.Join(failedDir, unsafeJobIdCharacters.ReplaceAllString(jobId, "_")+"-"+filepath.Base(filePath))
+	}
+
+	if err := moveFile(filePath, failedPath); err != nil {
+		return "", fmt.Errorf("failed to move %s to %s: %w", filePath, failedPath, err)
+	}
+	return failedPath, nil
 }
 
-func sortFilesToFolders(filePaths []string, consoleFolderPath string) error {
+// groupByDetectedConsole sorts untagged files by the console recognized from
+// their content, files of unknown or not configured consoles are left out.
+func (c *FsClient) groupByDetectedConsole(filePaths []string) map[string][]string {
+	filesByRomType := make(map[string][]string)
+	for _, filePath := range filePaths {
+		romType := detectRomType(filePath)
+		if romType == "" {
+			log.Printf("Console of file %s was not recognized\n", filePath)
+			continue
+		}
+
+		if _, err := c.getConsoleFolder(romType); err != nil {
+			log.Printf("File %s detected as %s: %v\n", filePath, romType, err)
+			continue
+		}
+
+		log.Printf("File %s detected as %s\n", filePath, romType)
+		filesByRomType[romType] = append(filesByRomType[romType], filePath)
+	}
+	return filesByRomType
+}
+
+func (c *FsClient) sortFilesToFolders(filePaths []string, romType string, result *ProcessResult) error {
+	consoleFolderPath, err := c.getConsoleFolder(romType)
+	if err != nil {
+		return &StageError{Stage: StageRoute, Err: err}
+	}
+
 	// Ensure the destination folder exists
-	err := os.MkdirAll(consoleFolderPath, os.ModePerm)
+	err = os.MkdirAll(consoleFolderPath, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("failed to create console folder: %w", err)
+		return &StageError{Stage: StageMove, Err: fmt.Errorf("failed to create console folder: %w", err)}
 	}
 
+	policy := c.config.ConflictPolicy(romType)
+	moved := 0
 	for _, filePath := range filePaths {
 		fileName := filepath.Base(filePath)
 
-		destinationPath := filepath.Join(consoleFolderPath, fileName)
+		// Hashed before moving, so skipped files are recorded as well
+		size, sha1Hash, crc32Hash, err := digestFile(filePath)
+		if err != nil {
+			return &StageError{Stage: StageMove, Err: err}
+		}
 
-		err := os.Rename(filePath, destinationPath)
+		destinationPath, decision, err := resolveConflict(filePath, filepath.Join(consoleFolderPath, fileName), policy)
 		if err != nil {
-			return fmt.Errorf("failed to move file %s: %w", filePath, err)
+			return &StageError{Stage: StageMove, Err: fmt.Errorf("failed to resolve conflict for file %s: %w", filePath, err)}
 		}
+
+		installedFile := InstalledFile{
+			SourcePath:      filePath,
+			DestinationPath: destinationPath,
+			RomType:         romType,
+			Conflict:        decision != DecisionInstalled,
+			Decision:        decision,
+			Size:            size,
+			Sha1:            sha1Hash,
+			Crc32:           crc32Hash,
+		}
+		if installedFile.Conflict {
+			installedFile.Policy = policy
+			log.Printf("File %s already exists in %s, policy %s: %s\n", fileName, consoleFolderPath, policy, decision)
+		}
+
+		if destinationPath != "" {
+			err := moveFile(filePath, destinationPath)
+			if err != nil {
+				return &StageError{Stage: StageMove, Err: fmt.Errorf("failed to move file %s: %w", filePath, err)}
+			}
+			moved++
+		}
+		result.Files = append(result.Files, installedFile)
 	}
 
-	log.Printf("Moved %d files to %s\n", len(filePaths), consoleFolderPath)
+	log.Printf("Moved %d files to %s\n", moved, consoleFolderPath)
 	return nil
 }
 
-func (c *FsClient) getConsoleFolder(identifier *ConsoleIdentifier) (string, error) {
-	consoleFolder, exists := c.config.RomTypeDestinations[*identifier.CustomExtension]
+// SweepStaleJobs removes working directories left behind by jobs of a previous
+// run, except the ones of jobs that are going to be resumed.
+func (c *FsClient) SweepStaleJobs(activeJobIds []string) {
+	activeDirs := make(map[string]struct{}, len(activeJobIds))
+	for _, jobId := range activeJobIds {
+		activeDirs[c.getJobDir(jobId)] = struct{}{}
+	}
+
+	// Older versions extracted every job into one shared folder
+	staleDirs := []string{filepath.Join(c.config.TempFolder, extractedDirName)}
+
+	jobsDir := filepath.Join(c.config.TempFolder, jobsFolderName)
+	entries, err := os.ReadDir(jobsDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error reading jobs directory %s: %v", jobsDir, err)
+	}
+	for _, entry := range entries {
+		jobDir := filepath.Join(jobsDir, entry.Name())
+		if _, active := activeDirs[jobDir]; entry.IsDir() && !active {
+			staleDirs = append(staleDirs, jobDir)
+		}
+	}
+
+	for _, staleDir := range staleDirs {
+		if !FileExists(staleDir) {
+			continue
+		}
+		if err := os.RemoveAll(staleDir); err != nil {
+			log.Printf("Error removing stale job directory %s: %v", staleDir, err)
+			continue
+		}
+		log.Printf("Removed stale job directory %s", staleDir)
+	}
+}
+
+func (c *FsClient) getJobDir(jobId string) string {
+	return filepath.Join(c.config.TempFolder, jobsFolderName, unsafeJobIdCharacters.ReplaceAllString(jobId, "_"))
+}
+
+func (c *FsClient) getConsoleFolder(romType string) (string, error) {
+	consoleFolder, exists := c.config.RomTypeDestinations[romType]
 	fullConsoleFolder := filepath.Join(c.config.DestinationFolderRoot, consoleFolder)
 	if !exists {
-		return "", fmt.Errorf("no destination folder configured for ROM type: %s", *identifier.CustomExtension)
+		return "", fmt.Errorf("%w: %s", ErrRomTypeNotConfigured, romType)
 	}
 
 	return fullConsoleFolder, nil
@@ -0,0 +1,69 @@
+package local
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Longest line ReadJSONLines accepts, a longer one fails the read
+const maxJSONLineBytes = 16 * 1024 * 1024
+
+// AppendJSONLine appends the value to the JSON lines file, it is on disk once the call returns.
+func AppendJSONLine(path string, value any) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	return WriteJSONLine(file, value)
+}
+
+// WriteJSONLine appends the value to a JSON lines file that is kept open.
+func WriteJSONLine(file *os.File, value any) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode line of %s: %w", file.Name(), err)
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write line to %s: %w", file.Name(), err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", file.Name(), err)
+	}
+	return nil
+}
+
+// ReadJSONLines passes every line of the file to add, a missing file has no
+// lines. A power loss can leave the last line half written, lines that do not
+// decode are skipped. Callers appending to the file afterwards rewrite it
+// first, a line appended to the broken one would be lost with it.
+func ReadJSONLines[T any](path string, add func(*T)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxJSONLineBytes)
+	for scanner.Scan() {
+		var value T
+		if err := json.Unmarshal(scanner.Bytes(), &value); err != nil {
+			log.Printf("Skipping corrupted line of %s: %v", path, err)
+			continue
+		}
+		add(&value)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"rom-downloader/config"
+)
+
+// ExtractionLimitError is returned when an archive exceeds one of the configured extraction limits.
+type ExtractionLimitError struct {
+	Archive string
+	Limit   string
+	Value   int64
+	Max     int64
+}
+
+func (e *ExtractionLimitError) Error() string {
+	return fmt.Sprintf("archive %s exceeds %s limit: %d > %d", e.Archive, e.Limit, e.Value, e.Max)
+}
+
+var errFreeSpaceUnsupported = errors.New("free space check is not supported on this platform")
+
+// extractionLimiter tracks what one archive has unpacked so far.
+type extractionLimiter struct {
+	archivePath string
+	archiveSize int64
+	limits      config.ExtractionLimits
+	totalBytes  int64
+	entries     int
+}
+
+func newExtractionLimiter(archivePath string, limits config.ExtractionLimits) (*extractionLimiter, error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat archive %s: %w", archivePath, err)
+	}
+
+	return &extractionLimiter{
+		archivePath: archivePath,
+		archiveSize: info.Size(),
+		limits:      limits,
+	}, nil
+}
+
+// addEntry counts a file entry, declaredSize is what the archive header claims (-1 when unknown).
+func (l *extractionLimiter) addEntry(declaredSize int64) error {
+	l.entries++
+	if l.entries > l.limits.MaxEntries {
+		return l.limitError("entry count", int64(l.entries), int64(l.limits.MaxEntries))
+	}
+
+	if declaredSize > l.limits.MaxFileBytes {
+		return l.limitError("file size", declaredSize, l.limits.MaxFileBytes)
+	}
+	return nil
+}
+
+// copy writes one entry while enforcing the limits on the real number of bytes,
+// headers of a malicious archive can not be trusted.
+func (l *extractionLimiter) copy(dst io.Writer, src io.Reader) error {
+	maxEntryBytes := l.limits.MaxFileBytes
+	if remaining := l.limits.MaxTotalBytes - l.totalBytes; remaining < maxEntryBytes {
+		maxEntryBytes = remaining
+	}
+	if remaining := l.maxRatioBytes() - l.totalBytes; remaining < maxEntryBytes {
+		maxEntryBytes = remaining
+	}
+
+	written, err := io.Copy(dst, io.LimitReader(src, maxEntryBytes+1))
+	l.totalBytes += written
+	if err != nil {
+		return err
+	}
+
+	if written > l.limits.MaxFileBytes {
+		return l.limitError("file size", written, l.limits.MaxFileBytes)
+	}
+	if l.totalBytes > l.limits.MaxTotalBytes {
+		return l.limitError("total size", l.totalBytes, l.limits.MaxTotalBytes)
+	}
+	if l.totalBytes > l.maxRatioBytes() {
+		return l.limitError("compression ratio", l.totalBytes/max(l.archiveSize, 1), int64(l.limits.MaxCompressionRatio))
+	}
+	return nil
+}
+
+// maxRatioBytes is the most the archive may unpack to without breaking the compression ratio limit.
+func (l *extractionLimiter) maxRatioBytes() int64 {
+	return int64(float64(max(l.archiveSize, 1)) * l.limits.MaxCompressionRatio)
+}
+
+func (l *extractionLimiter) limitError(limit string, value int64, max int64) error {
+	return &ExtractionLimitError{Archive: l.archivePath, Limit: limit, Value: value, Max: max}
+}
+
+// checkFreeSpace makes sure every folder has room for requiredBytes plus the configured reserve.
+func checkFreeSpace(requiredBytes int64, limits config.ExtractionLimits, folders ...string) error {
+	for _, folder := range folders {
+		available, err := FreeSpace(folder)
+		if errors.Is(err, errFreeSpaceUnsupported) {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Could not get free space of %s: %v", folder, err)
+			continue
+		}
+
+		needed := uint64(requiredBytes + limits.MinFreeBytes)
+		if available < needed {
+			return fmt.Errorf(
+				"not enough free space in %s: %d bytes available, %d bytes needed",
+				folder, available, needed)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// moveFile moves the file into place so the destination folder never shows a
+// half-written ROM, also when the source sits on another filesystem.
+func moveFile(sourcePath string, destinationPath string) error {
+	err := os.Rename(sourcePath, destinationPath)
+	if err == nil {
+		return nil
+	}
+
+	// Temp folder on the SD card and ROMs on a USB drive or NAS can not be renamed across
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	return copyAcrossDevices(sourcePath, destinationPath)
+}
+
+func copyAcrossDevices(sourcePath string, destinationPath string) error {
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", sourcePath, err)
+	}
+	defer sourceFile.Close()
+
+	sourceInfo, err := sourceFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", sourcePath, err)
+	}
+
+	// Hidden temp name in the destination folder, renamed only once fully written
+	destinationDir := filepath.Dir(destinationPath)
+	tempFile, err := os.CreateTemp(destinationDir, "."+filepath.Base(destinationPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file in %s: %w", destinationDir, err)
+	}
+	tempPath := tempFile.Name()
+
+	err = writeTempCopy(tempFile, sourceFile, sourceInfo)
+	if err == nil {
+		err = os.Rename(tempPath, destinationPath)
+	}
+	if err != nil {
+		if removeErr := os.Remove(tempPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Printf("Error removing temp file %s: %v", tempPath, removeErr)
+		}
+		return fmt.Errorf("failed to copy %s to %s: %w", sourcePath, destinationPath, err)
+	}
+
+	if err := syncDir(destinationDir); err != nil {
+		log.Printf("Error syncing folder %s: %v", destinationDir, err)
+	}
+
+	return os.Remove(sourcePath)
+}
+
+// writeTempCopy copies the content, makes it durable and closes the temp file.
+func writeTempCopy(tempFile *os.File, sourceFile *os.File, sourceInfo os.FileInfo) error {
+	if _, err := io.Copy(tempFile, sourceFile); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tempFile.Name(), sourceInfo.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(tempFile.Name(), sourceInfo.ModTime(), sourceInfo.ModTime())
+}
+
+// syncDir persists the rename itself, not supported on every platform.
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	err = dir.Sync()
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, os.ErrInvalid) {
+		return nil
+	}
+	return err
+}
@@ -10,8 +10,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"rom-downloader/config"
 	"strings"
+	"time"
 
+	"github.com/bodgit/sevenzip"
 	"github.com/nwaples/rardecode"
 )
 
@@ -20,12 +23,22 @@ type ConsoleIdentifier struct {
 	FileExtension   string  // Real file extension (after ".")
 }
 
-var supportedArchives = map[string]func(string, string, *[]string) error{
+// Failures that repeating the job would not fix
+var (
+	ErrInvalidFileName      = errors.New("invalid format")
+	ErrUnsupportedArchive   = errors.New("unsupported archive format")
+	ErrIllegalPath          = errors.New("illegal file path")
+	ErrRomTypeNotConfigured = errors.New("no destination folder configured for ROM type")
+	ErrRomTypeNotRecognized = errors.New("file is not tagged and its console was not recognized")
+)
+
+var supportedArchives = map[string]func(string, string, *extractionLimiter, *[]string) error{
 	".zip": extractZipWithPaths,
 	".tar": extractTarWithPaths,
 	".gz":  extractTarGzWithPaths,
 	".tgz": extractTarGzWithPaths,
 	".rar": extractRarWithPaths,
+	".7z":  extract7zWithPaths,
 }
 
 func FileExists(filePath string) bool {
@@ -43,13 +56,13 @@ func getFileExtensions(filePath string) (*ConsoleIdentifier, error) {
 	dotIndex := strings.LastIndex(fileName, ".")
 	if dotIndex == -1 {
 		log.Printf("Skipping file %s: Invalid format (no valid '.')\n", filePath)
-		return nil, fmt.Errorf("invalid format: no valid '.' in %s", filePath)
+		return nil, fmt.Errorf("%w: no valid '.' in %s", ErrInvalidFileName, filePath)
 	}
 
 	fileExtension := fileName[dotIndex:]
 	if fileExtension == "" {
 		log.Printf("Skipping file %s: Empty file extension after '.'\n", filePath)
-		return nil, fmt.Errorf("invalid format: empty file extension in %s", filePath)
+		return nil, fmt.Errorf("%w: empty file extension in %s", ErrInvalidFileName, filePath)
 	}
 
 	underscoreIndex := strings.LastIndex(fileName, "_")
@@ -76,7 +89,7 @@ func fileIsArchive(filePath string) bool {
 	return isArchive
 }
 
-func ExtractArchive(archivePath, destinationPath string) ([]string, error) {
+func ExtractArchive(archivePath, destinationPath string, limits config.ExtractionLimits) ([]string, error) {
 	// Ensure the destination path exists
 	if err := os.MkdirAll(destinationPath, os.ModePerm); err != nil {
 		return nil, fmt.Errorf("failed to create destination directory: %w", err)
@@ -86,16 +99,59 @@ func ExtractArchive(archivePath, destinationPath string) ([]string, error) {
 	lowerExt := strings.ToLower(filepath.Ext(archivePath))
 	extractFunc, supported := supportedArchives[lowerExt]
 	if !supported {
-		return nil, fmt.Errorf("unsupported archive format: %s", lowerExt)
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedArchive, lowerExt)
+	}
+
+	limiter, err := newExtractionLimiter(archivePath, limits)
+	if err != nil {
+		return nil, err
 	}
 
 	// Extract files and collect their paths
 	var extractedFiles []string
-	err := extractFunc(archivePath, destinationPath, &extractedFiles) // Call the appropriate extraction function
+	err = extractFunc(archivePath, destinationPath, limiter, &extractedFiles) // Call the appropriate extraction function
 	return extractedFiles, err
 }
 
-func extractZipWithPaths(filePath, destination string, extractedFiles *[]string) error {
+// estimateUncompressedSize sums the sizes from the archive headers when the format
+// has them up front, otherwise the archive size is the best guess available.
+func estimateUncompressedSize(archivePath string) int64 {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return 0
+	}
+
+	var total int64
+	switch strings.ToLower(filepath.Ext(archivePath)) {
+	case ".zip":
+		reader, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return info.Size()
+		}
+		defer reader.Close()
+
+		for _, file := range reader.File {
+			total += int64(file.UncompressedSize64)
+		}
+	case ".7z":
+		reader, err := sevenzip.OpenReader(archivePath)
+		if err != nil {
+			return info.Size()
+		}
+		defer reader.Close()
+
+		for _, file := range reader.File {
+			total += int64(file.UncompressedSize)
+		}
+	}
+
+	if total < info.Size() {
+		return info.Size()
+	}
+	return total
+}
+
+func extractZipWithPaths(filePath, destination string, limiter *extractionLimiter, extractedFiles *[]string) error {
 	reader, err := zip.OpenReader(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open zip file: %w", err)
@@ -107,13 +163,16 @@ func extractZipWithPaths(filePath, destination string, extractedFiles *[]string)
 
 		// Check for directory traversal vulnerability
 		if !strings.HasPrefix(extractedFilePath, filepath.Clean(destination)+string(os.PathSeparator)) {
-			return errors.New("illegal file path in zip (directory traversal attack)")
+			return fmt.Errorf("%w in zip (directory traversal attack)", ErrIllegalPath)
 		}
 
 		if file.FileInfo().IsDir() {
 			os.MkdirAll(extractedFilePath, os.ModePerm)
 		} else {
-			err := extractFileFromZip(file, extractedFilePath)
+			if err := limiter.addEntry(int64(file.UncompressedSize64)); err != nil {
+				return err
+			}
+			err := extractFileFromZip(file, extractedFilePath, limiter)
 			if err != nil {
 				return err
 			}
@@ -123,34 +182,58 @@ func extractZipWithPaths(filePath, destination string, extractedFiles *[]string)
 	return nil
 }
 
-func extractFileFromZip(file *zip.File, destinationPath string) error {
+func extractFileFromZip(file *zip.File, destinationPath string, limiter *extractionLimiter) error {
 	fileReader, err := file.Open()
 	if err != nil {
 		return fmt.Errorf("failed to open file from zip: %w", err)
 	}
 	defer fileReader.Close()
 
+	return writeExtractedFile(destinationPath, fileReader, file.Modified, limiter)
+}
+
+// writeExtractedFile writes one archive entry to disk within the limits of the archive,
+// keeping its modification time so newer ROMs can be told apart from older ones.
+func writeExtractedFile(destinationPath string, reader io.Reader, modTime time.Time, limiter *extractionLimiter) error {
+	// Members may sit in folders that have no own entry in the archive
+	if err := os.MkdirAll(filepath.Dir(destinationPath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
 	destinationFile, err := os.Create(destinationPath)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
-	defer destinationFile.Close()
 
-	_, err = io.Copy(destinationFile, fileReader)
-	return err
+	if err := limiter.copy(destinationFile, reader); err != nil {
+		// Leave no partial file behind, it is not collected for cleanup yet
+		destinationFile.Close()
+		os.Remove(destinationPath)
+		return fmt.Errorf("failed to write file content: %w", err)
+	}
+
+	if err := destinationFile.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(destinationPath, modTime, modTime); err != nil {
+			log.Printf("Error setting modification time of %s: %v", destinationPath, err)
+		}
+	}
+	return nil
 }
 
-func extractTarWithPaths(filePath, destination string, extractedFiles *[]string) error {
+func extractTarWithPaths(filePath, destination string, limiter *extractionLimiter, extractedFiles *[]string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open tar file: %w", err)
 	}
 	defer file.Close()
 
-	return extractTarContentsWithPaths(file, destination, extractedFiles)
+	return extractTarContentsWithPaths(file, destination, limiter, extractedFiles)
 }
 
-func extractTarGzWithPaths(filePath, destination string, extractedFiles *[]string) error {
+func extractTarGzWithPaths(filePath, destination string, limiter *extractionLimiter, extractedFiles *[]string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open tar.gz file: %w", err)
@@ -163,10 +246,10 @@ func extractTarGzWithPaths(filePath, destination string, extractedFiles *[]strin
 	}
 	defer gzipReader.Close()
 
-	return extractTarContentsWithPaths(gzipReader, destination, extractedFiles)
+	return extractTarContentsWithPaths(gzipReader, destination, limiter, extractedFiles)
 }
 
-func extractTarContentsWithPaths(reader io.Reader, destination string, extractedFiles *[]string) error {
+func extractTarContentsWithPaths(reader io.Reader, destination string, limiter *extractionLimiter, extractedFiles *[]string) error {
 	tarReader := tar.NewReader(reader)
 
 	for {
@@ -183,7 +266,7 @@ func extractTarContentsWithPaths(reader io.Reader, destination string, extracted
 
 		// Check for directory traversal vulnerability
 		if !strings.HasPrefix(extractedFilePath, filepath.Clean(destination)+string(os.PathSeparator)) {
-			return errors.New("illegal file path in tar (directory traversal attack)")
+			return fmt.Errorf("%w in tar (directory traversal attack)", ErrIllegalPath)
 		}
 
 		switch header.Typeflag {
@@ -192,14 +275,11 @@ func extractTarContentsWithPaths(reader io.Reader, destination string, extracted
 				return fmt.Errorf("failed to create directory: %w", err)
 			}
 		case tar.TypeReg:
-			destinationFile, err := os.Create(extractedFilePath)
-			if err != nil {
-				return fmt.Errorf("failed to create file: %w", err)
+			if err := limiter.addEntry(header.Size); err != nil {
+				return err
 			}
-			defer destinationFile.Close()
-
-			if _, err := io.Copy(destinationFile, tarReader); err != nil {
-				return fmt.Errorf("failed to write file content: %w", err)
+			if err := writeExtractedFile(extractedFilePath, tarReader, header.ModTime, limiter); err != nil {
+				return err
 			}
 			*extractedFiles = append(*extractedFiles, extractedFilePath) // Collect file path
 		default:
@@ -210,7 +290,7 @@ func extractTarContentsWithPaths(reader io.Reader, destination string, extracted
 	return nil
 }
 
-func extractRarWithPaths(filePath, destination string, extractedFiles *[]string) error {
+func extractRarWithPaths(filePath, destination string, limiter *extractionLimiter, extractedFiles *[]string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open rar file: %w", err)
@@ -236,7 +316,7 @@ func extractRarWithPaths(filePath, destination string, extractedFiles *[]string)
 
 		// Check for directory traversal vulnerability
 		if !strings.HasPrefix(extractedFilePath, filepath.Clean(destination)+string(os.PathSeparator)) {
-			return errors.New("illegal file path in rar (directory traversal attack)")
+			return fmt.Errorf("%w in rar (directory traversal attack)", ErrIllegalPath)
 		}
 
 		if header.IsDir {
@@ -244,14 +324,15 @@ func extractRarWithPaths(filePath, destination string, extractedFiles *[]string)
 				return fmt.Errorf("failed to create directory: %w", err)
 			}
 		} else {
-			destinationFile, err := os.Create(extractedFilePath)
-			if err != nil {
-				return fmt.Errorf("failed to create file: %w", err)
+			declaredSize := header.UnPackedSize
+			if header.UnKnownSize {
+				declaredSize = -1
 			}
-			defer destinationFile.Close()
-
-			if _, err := io.Copy(destinationFile, rarReader); err != nil {
-				return fmt.Errorf("failed to write file content: %w", err)
+			if err := limiter.addEntry(declaredSize); err != nil {
+				return err
+			}
+			if err := writeExtractedFile(extractedFilePath, rarReader, header.ModificationTime, limiter); err != nil {
+				return err
 			}
 			*extractedFiles = append(*extractedFiles, extractedFilePath) // Collect file path
 		}
@@ -259,3 +340,44 @@ func extractRarWithPaths(filePath, destination string, extractedFiles *[]string)
 
 	return nil
 }
+
+func extract7zWithPaths(filePath, destination string, limiter *extractionLimiter, extractedFiles *[]string) error {
+	reader, err := sevenzip.OpenReader(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open 7z file: %w", err)
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+		extractedFilePath := filepath.Join(destination, file.Name)
+
+		// Check for directory traversal vulnerability
+		if !strings.HasPrefix(extractedFilePath, filepath.Clean(destination)+string(os.PathSeparator)) {
+			return fmt.Errorf("%w in 7z (directory traversal attack)", ErrIllegalPath)
+		}
+
+		if file.FileInfo().IsDir() {
+			os.MkdirAll(extractedFilePath, os.ModePerm)
+		} else {
+			if err := limiter.addEntry(int64(file.UncompressedSize)); err != nil {
+				return err
+			}
+			err := extractFileFrom7z(file, extractedFilePath, limiter)
+			if err != nil {
+				return err
+			}
+			*extractedFiles = append(*extractedFiles, extractedFilePath) // Collect file path
+		}
+	}
+	return nil
+}
+
+func extractFileFrom7z(file *sevenzip.File, destinationPath string, limiter *extractionLimiter) error {
+	fileReader, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open file from 7z: %w", err)
+	}
+	defer fileReader.Close()
+
+	return writeExtractedFile(destinationPath, fileReader, file.Modified, limiter)
+}
@@ -0,0 +1,104 @@
+package subscribing
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"rom-downloader/config"
+	"strings"
+	"sync"
+)
+
+// DropFolderSource turns files copied into a local folder (SMB share, USB
+// stick, ...) into messages, so they go through the same processing as
+// uploads without any cloud involved.
+type DropFolderSource struct {
+	config  *config.LoaderConfig
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+func NewDropFolderSource(config *config.LoaderConfig) *DropFolderSource {
+	return &DropFolderSource{
+		config:  config,
+		pending: make(map[string]struct{}),
+	}
+}
+
+// scanExisting emits files that were dropped while the client was not running.
+func (s *DropFolderSource) scanExisting(ctx context.Context, messages chan<- ReceivedMessage) error {
+	entries, err := os.ReadDir(s.config.DropFolder)
+	if err != nil {
+		return fmt.Errorf("failed to read drop folder %s: %w", s.config.DropFolder, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if !s.emit(ctx, messages, entry.Name()) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// emit sends a message for the dropped file, returns false when the context got cancelled.
+func (s *DropFolderSource) emit(ctx context.Context, messages chan<- ReceivedMessage, fileName string) bool {
+	// Hidden files are usually partial copies (rsync, SMB clients)
+	if strings.HasPrefix(fileName, ".") {
+		return true
+	}
+
+	filePath := filepath.Join(s.config.DropFolder, fileName)
+	info, err := os.Stat(filePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return true
+	}
+
+	s.mu.Lock()
+	if _, exists := s.pending[filePath]; exists {
+		s.mu.Unlock()
+		return true
+	}
+	s.pending[filePath] = struct{}{}
+	s.mu.Unlock()
+
+	message := RomUploadedMessage{
+		MessageId: dropMessageId(fileName, info),
+		File:      fileName,
+		Created:   info.ModTime().UTC(),
+		Updated:   info.ModTime().UTC(),
+		LocalPath: filePath,
+	}
+	log.Printf("Found file %s in drop folder", filePath)
+
+	settle := func() { s.release(filePath) }
+	nack := func() {
+		log.Printf("Processing of dropped file %s failed", filePath)
+		s.release(filePath)
+	}
+
+	select {
+	case messages <- NewReceivedMessage(message, settle, nack):
+		return true
+	case <-ctx.Done():
+		s.release(filePath)
+		return false
+	}
+}
+
+func (s *DropFolderSource) release(filePath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, filePath)
+}
+
+func dropMessageId(fileName string, info os.FileInfo) string {
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%d", fileName, info.Size(), info.ModTime().UnixNano())))
+	return "drop-" + hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,94 @@
+package subscribing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const dropFolderPollInterval = 500 * time.Millisecond
+
+func (s *DropFolderSource) Start(ctx context.Context, messages chan<- ReceivedMessage) error {
+	if err := os.MkdirAll(s.config.DropFolder, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create drop folder %s: %w", s.config.DropFolder, err)
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+	defer func() {
+		if err := unix.Close(fd); err != nil {
+			log.Printf("Error closing inotify descriptor: %v", err)
+		}
+	}()
+
+	// Only react to finished writes and files moved in, never to half-copied ones
+	_, err = unix.InotifyAddWatch(fd, s.config.DropFolder, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO)
+	if err != nil {
+		return fmt.Errorf("failed to watch drop folder %s: %w", s.config.DropFolder, err)
+	}
+	log.Printf("Watching drop folder: %s", s.config.DropFolder)
+
+	// Watch is registered first, so nothing copied during the scan gets missed
+	if err := s.scanExisting(ctx, messages); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	pollFds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		ready, err := unix.Poll(pollFds, int(dropFolderPollInterval.Milliseconds()))
+		if errors.Is(err, unix.EINTR) || ready == 0 {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to poll inotify: %w", err)
+		}
+
+		read, err := unix.Read(fd, buffer)
+		if errors.Is(err, unix.EAGAIN) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read inotify events: %w", err)
+		}
+
+		for _, fileName := range parseInotifyEvents(buffer[:read]) {
+			if !s.emit(ctx, messages, fileName) {
+				return nil
+			}
+		}
+	}
+}
+
+func parseInotifyEvents(buffer []byte) []string {
+	var fileNames []string
+	offset := 0
+	for offset+unix.SizeofInotifyEvent <= len(buffer) {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+		nameStart := offset + unix.SizeofInotifyEvent
+		nameEnd := nameStart + int(event.Len)
+		if nameEnd > len(buffer) {
+			break
+		}
+
+		if event.Mask&unix.IN_ISDIR == 0 && event.Len > 0 {
+			name := string(bytes.TrimRight(buffer[nameStart:nameEnd], "\x00"))
+			fileNames = append(fileNames, name)
+		}
+		offset = nameEnd
+	}
+	return fileNames
+}
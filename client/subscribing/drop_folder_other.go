@@ -0,0 +1,12 @@
+//go:build !linux
+
+package subscribing
+
+import (
+	"context"
+	"errors"
+)
+
+func (s *DropFolderSource) Start(_ context.Context, _ chan<- ReceivedMessage) error {
+	return errors.New("drop folder source is only supported on linux")
+}
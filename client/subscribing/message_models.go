@@ -8,4 +8,35 @@ type RomUploadedMessage struct {
 	File      string    `json:"file"`
 	Created   time.Time `json:"created"`
 	Updated   time.Time `json:"updated"`
+	LocalPath string    `json:"-"` // Set when the file is already on disk and needs no download
+}
+
+func (m *RomUploadedMessage) IsLocal() bool {
+	return m.LocalPath != ""
+}
+
+// ReceivedMessage carries a RomUploadedMessage together with the handle used
+// to settle it once the whole pipeline has finished with it.
+type ReceivedMessage struct {
+	RomUploadedMessage
+	ack  func()
+	nack func()
+}
+
+func NewReceivedMessage(message RomUploadedMessage, ack func(), nack func()) ReceivedMessage {
+	return ReceivedMessage{RomUploadedMessage: message, ack: ack, nack: nack}
+}
+
+// Ack confirms the message was fully processed, it will not be redelivered.
+func (m *ReceivedMessage) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// Nack signals the processing failed, so the message gets redelivered.
+func (m *ReceivedMessage) Nack() {
+	if m.nack != nil {
+		m.nack()
+	}
 }
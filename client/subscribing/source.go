@@ -0,0 +1,24 @@
+package subscribing
+
+import (
+	"context"
+	"fmt"
+	"rom-downloader/config"
+)
+
+// MessageSource produces ROM messages for the processing loop until the
+// context is cancelled.
+type MessageSource interface {
+	Start(ctx context.Context, messages chan<- ReceivedMessage) error
+}
+
+func NewMessageSource(configuration *config.LoaderConfig) (MessageSource, error) {
+	switch configuration.MessageSource {
+	case config.MessageSourcePubSub:
+		return NewPubSubSource(configuration), nil
+	case config.MessageSourceDropFolder:
+		return NewDropFolderSource(configuration), nil
+	default:
+		return nil, fmt.Errorf("unknown message source: %s", configuration.MessageSource)
+	}
+}
@@ -4,24 +4,32 @@ import (
 	"cloud.google.com/go/pubsub"
 	"context"
 	"encoding/json"
+	"fmt"
 	"google.golang.org/api/option"
 	"log"
 	"rom-downloader/config"
+	"time"
 )
 
-func StartSubscriber(
-	ctx context.Context,
-	config *config.LoaderConfig,
-	messages chan<- RomUploadedMessage,
-) {
+const maxAckExtension = 2 * time.Hour
+
+type PubSubSource struct {
+	config *config.LoaderConfig
+}
+
+func NewPubSubSource(config *config.LoaderConfig) *PubSubSource {
+	return &PubSubSource{config: config}
+}
+
+func (s *PubSubSource) Start(ctx context.Context, messages chan<- ReceivedMessage) error {
 	client, err := pubsub.NewClient(
 		ctx,
-		config.ProjectID,
-		option.WithCredentialsFile(config.CredentialsFileName),
+		s.config.ProjectID,
+		option.WithCredentialsFile(s.config.CredentialsFileName),
 	)
 
 	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+		return fmt.Errorf("failed to create client: %w", err)
 	}
 	defer func() {
 		if err := client.Close(); err != nil {
@@ -29,7 +37,10 @@ func StartSubscriber(
 		}
 	}()
 
-	sub := client.Subscription(config.SubscriptionName)
+	sub := client.Subscription(s.config.SubscriptionName)
+	// Messages stay unacked until the ROM is installed and recorded, the client
+	// keeps extending their deadline meanwhile, so give big downloads enough time.
+	sub.ReceiveSettings.MaxExtension = maxAckExtension
 	log.Printf("Created subscriber for subscription: %s", sub.ID())
 
 	err = sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
@@ -41,10 +52,15 @@ func StartSubscriber(
 			return
 		}
 		message.MessageId = m.ID
-		messages <- message
-		m.Ack()
+
+		select {
+		case messages <- NewReceivedMessage(message, m.Ack, m.Nack):
+		case <-ctx.Done():
+			m.Nack()
+		}
 	})
 	if err != nil {
-		log.Fatalf("Failed to receive message: %v", err)
+		return fmt.Errorf("failed to receive message: %w", err)
 	}
+	return nil
 }
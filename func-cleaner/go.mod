@@ -49,4 +49,7 @@ require (
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20241209162323-e6fa225c2576 // indirect
 	google.golang.org/grpc v1.70.0 // indirect
 	google.golang.org/protobuf v1.36.4 // indirect
+	pushauth v0.0.0-00010101000000-000000000000 // indirect
 )
+
+replace pushauth => ../pushauth
@@ -2,23 +2,104 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
+	"pushauth"
 )
 
+const (
+	defaultDevicesCollection = "devices"
+	defaultMinAgeHours       = 24
+	defaultConcurrency       = 8
+	defaultSilentAfterDays   = 30
+)
+
+type cleanupOutcome int
+
+const (
+	outcomeDeleted cleanupOutcome = iota
+	outcomeSkipped
+	outcomeFailed
+)
+
+type completeDownload struct {
+	MessageId    string     `firestore:"messageId"`
+	FileName     string     `firestore:"fileName"`
+	BucketName   string     `firestore:"bucketName"`
+	DeviceId     string     `firestore:"deviceId"`
+	Generation   int64      `firestore:"generation"`
+	DownloadedAt time.Time  `firestore:"downloadedAt"`
+	IsDeleted    bool       `firestore:"isDeleted"`
+	DeletedAt    *time.Time `firestore:"deletedAt"`
+}
+
+type registeredDevice struct {
+	DeviceId     string    `firestore:"deviceId"`
+	RegisteredAt time.Time `firestore:"registeredAt"`
+	LastSeenAt   time.Time `firestore:"lastSeenAt"`
+	Retired      bool      `firestore:"retired"` // Set by hand for devices that are gone for good
+}
+
+// uploadedObject groups the confirmations of one object generation.
+type uploadedObject struct {
+	bucketName  string
+	fileName    string
+	generation  int64 // Zero for documents written before generations were recorded
+	documents   []*firestore.DocumentSnapshot
+	confirmedBy map[string]struct{}
+	confirmedAt time.Time // Latest confirmation, the minimum age counts from it
+}
+
+// cleanupOptions control which objects a run may delete.
+type cleanupOptions struct {
+	minAge          time.Duration
+	dryRun          bool
+	includePrefixes []string // Empty includes every object
+	excludePrefixes []string
+	concurrency     int
+	silentAfter     time.Duration // Devices not seen for longer are not waited for, zero waits for every device
+}
+
+// cleanupReport lists what the run deleted, or would delete in a dry run, what
+// it left alone and what failed, with the reasons.
+type cleanupReport struct {
+	DryRun  bool             `json:"dryRun"`
+	Deleted []reportedObject `json:"deleted"`
+	Skipped []reportedObject `json:"skipped"`
+	Failed  []reportedObject `json:"failed"`
+}
+
+type reportedObject struct {
+	Bucket     string `json:"bucket"`
+	File       string `json:"file"`
+	Generation int64  `json:"generation"`
+	Reason     string `json:"reason,omitempty"`
+}
+
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	http.HandleFunc("/", CleanupHandler)
+
+	verifier, err := pushauth.NewVerifier(pushauth.ConfigFromEnv())
+	if err != nil {
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+	http.Handle("/", verifier.Middleware(http.HandlerFunc(CleanupHandler)))
 
 	log.Printf("Starting server on port %s...", port)
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
@@ -26,9 +107,18 @@ func main() {
 	}
 }
 
-func CleanupHandler(w http.ResponseWriter, _ *http.Request) {
+// CleanupHandler deletes the uploads every device installed and responds with
+// a JSON summary, with status 500 when any object failed. With the dryRun query
+// parameter it only reports what it would delete.
+func CleanupHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
-	log.Printf("Starting cleanup...")
+
+	options, err := optionsFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Starting cleanup (dry run: %t, minimum age: %s)...", options.dryRun, options.minAge)
 
 	// Initialize Firestore client
 	firestoreClient, err := firestore.NewClient(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"))
@@ -53,11 +143,31 @@ func CleanupHandler(w http.ResponseWriter, _ *http.Request) {
 		return
 	}
 
+	devicesCollectionName := os.Getenv("DEVICES_COLLECTION")
+	if devicesCollectionName == "" {
+		devicesCollectionName = defaultDevicesCollection
+	}
+
+	devices, err := loadDevices(ctx, firestoreClient.Collection(devicesCollectionName), time.Now(), options.silentAfter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading devices: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	collection := firestoreClient.Collection(collectionName)
 	query := collection.Where("isDeleted", "==", false)
 	iter := query.Documents(ctx)
 
-	totalDeleted := 0
+	report := cleanupReport{
+		DryRun:  options.dryRun,
+		Deleted: []reportedObject{},
+		Skipped: []reportedObject{},
+		Failed:  []reportedObject{},
+	}
+
+	// Every device that installed an object confirms it with its own document
+	objects := make(map[string]*uploadedObject)
+	var objectKeys []string
 
 	for {
 		doc, err := iter.Next()
@@ -70,48 +180,318 @@ func CleanupHandler(w http.ResponseWriter, _ *http.Request) {
 		}
 
 		// Map data to CompleteDownload structure
-		var data struct {
-			MessageId  string `firestore:"messageId"`
-			FileName   string `firestore:"fileName"`
-			BucketName string `firestore:"bucketName"`
-			DeletedAt  *time.Time
-		}
+		var data completeDownload
 		if err := doc.DataTo(&data); err != nil {
-			http.Error(w, fmt.Sprintf("Error mapping document data: %v", err), http.StatusInternalServerError)
-			return
+			log.Printf("Error mapping document %s: %v", doc.Ref.ID, err)
+			report.Failed = append(report.Failed, reportedObject{Reason: fmt.Sprintf("failed to map document %s: %v", doc.Ref.ID, err)})
+			continue
 		}
 
-		// Delete the file from Cloud Storage
-		err = deleteFileFromStorage(ctx, storageClient, data.BucketName, data.FileName)
+		key := fmt.Sprintf("%s/%s#%d", data.BucketName, data.FileName, data.Generation)
+		object, exists := objects[key]
+		if !exists {
+			object = &uploadedObject{
+				bucketName:  data.BucketName,
+				fileName:    data.FileName,
+				generation:  data.Generation,
+				confirmedBy: make(map[string]struct{}),
+			}
+			objects[key] = object
+			objectKeys = append(objectKeys, key)
+		}
+		object.documents = append(object.documents, doc)
+		object.confirmedBy[data.DeviceId] = struct{}{}
+		if data.DownloadedAt.After(object.confirmedAt) {
+			object.confirmedAt = data.DownloadedAt
+		}
+	}
+
+	cleaner := &objectCleaner{
+		storageClient: storageClient,
+		devices:       devices,
+		options:       options,
+		now:           time.Now().UTC(),
+	}
+
+	var reportMu sync.Mutex
+
+	// Objects are independent, a bounded pool keeps the storage and Firestore calls in flight
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	for range options.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				outcome, reported := cleaner.clean(ctx, objects[key])
+
+				reportMu.Lock()
+				switch outcome {
+				case outcomeDeleted:
+					report.Deleted = append(report.Deleted, reported)
+				case outcomeSkipped:
+					report.Skipped = append(report.Skipped, reported)
+				case outcomeFailed:
+					report.Failed = append(report.Failed, reported)
+				}
+				reportMu.Unlock()
+			}
+		}()
+	}
+	for _, key := range objectKeys {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+
+	report.sort()
+
+	if options.dryRun {
+		log.Printf("Dry run would delete %d files, skip %d files and %d files failed.", len(report.Deleted), len(report.Skipped), len(report.Failed))
+	} else {
+		log.Printf("Deleted %d files, skipped %d files and %d files failed.", len(report.Deleted), len(report.Skipped), len(report.Failed))
+	}
+
+	// Cloud Scheduler only counts a run as failed on an error status, the report still tells what happened
+	w.Header().Set("Content-Type", "application/json")
+	if len(report.Failed) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// objectCleaner decides about and deletes a single object, it is shared by the workers.
+type objectCleaner struct {
+	storageClient *storage.Client
+	devices       map[string]time.Time
+	options       cleanupOptions
+	now           time.Time
+}
+
+// clean deletes the object when every device confirmed it and marks its documents as deleted.
+// Errors are reported on the object instead of stopping the run.
+func (c *objectCleaner) clean(ctx context.Context, object *uploadedObject) (cleanupOutcome, reportedObject) {
+	if !c.options.matchesPrefix(object.fileName) {
+		return outcomeSkipped, object.reported("excluded by prefix filters")
+	}
+	if age := c.now.Sub(object.confirmedAt); age < c.options.minAge {
+		return outcomeSkipped, object.reported(fmt.Sprintf("confirmed %s ago, minimum age is %s", age.Truncate(time.Second), c.options.minAge))
+	}
+
+	deleted := object.reported("")
+	deleteFromStorage := true
+
+	attrs, err := c.storageClient.Bucket(object.bucketName).Object(object.fileName).Attrs(ctx)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		// Deleted by an earlier run that failed to update Firestore, or by hand
+		log.Printf("File %s/%s no longer exists, only marking it as deleted", object.bucketName, object.fileName)
+		deleted.Reason = "already deleted from storage"
+		deleteFromStorage = false
+	case err != nil:
+		log.Printf("Error getting attributes of file %s/%s: %v", object.bucketName, object.fileName, err)
+		return outcomeFailed, object.reported(fmt.Sprintf("failed to get attributes: %v", err))
+	case object.generation != 0 && attrs.Generation != object.generation:
+		// A newer upload replaced the confirmed generation, it is not ours to delete
+		log.Printf("File %s/%s was replaced by generation %d, only marking generation %d as deleted", object.bucketName, object.fileName, attrs.Generation, object.generation)
+		deleted.Reason = fmt.Sprintf("replaced by generation %d, only marked as deleted", attrs.Generation)
+		deleteFromStorage = false
+	default:
+		missing := object.missingDevices(c.devices, attrs.Created)
+		if len(missing) > 0 {
+			log.Printf("File %s/%s is waiting for devices %s", object.bucketName, object.fileName, strings.Join(missing, ", "))
+			return outcomeSkipped, object.reported("waiting for devices " + strings.Join(missing, ", "))
+		}
+	}
+
+	if c.options.dryRun {
+		return outcomeDeleted, deleted
+	}
+
+	if deleteFromStorage {
+		err = deleteFileFromStorage(ctx, c.storageClient, object.bucketName, object.fileName, object.generation)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to delete file %s/%s: %v", data.BucketName, data.FileName, err), http.StatusInternalServerError)
-			return
+			log.Printf("Error deleting file %s/%s: %v", object.bucketName, object.fileName, err)
+			return outcomeFailed, object.reported(err.Error())
 		}
+	}
 
+	deletedAt := time.Now().UTC()
+	for _, doc := range object.documents {
 		_, err = doc.Ref.Update(ctx, []firestore.Update{
 			{Path: "isDeleted", Value: true},
+			{Path: "deletedAt", Value: deletedAt},
 		})
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to update Firestore document %s: %v", doc.Ref.ID, err), http.StatusInternalServerError)
-			return
+			// The next run finds the object gone and retries the update
+			log.Printf("Error updating Firestore document %s: %v", doc.Ref.ID, err)
+			return outcomeFailed, object.reported(fmt.Sprintf("failed to update Firestore document %s: %v", doc.Ref.ID, err))
+		}
+	}
+
+	return outcomeDeleted, deleted
+}
+
+// sort orders the report by object, the workers finish in any order.
+func (r *cleanupReport) sort() {
+	for _, objects := range [][]reportedObject{r.Deleted, r.Skipped, r.Failed} {
+		sort.Slice(objects, func(i, j int) bool {
+			if objects[i].Bucket != objects[j].Bucket {
+				return objects[i].Bucket < objects[j].Bucket
+			}
+			if objects[i].File != objects[j].File {
+				return objects[i].File < objects[j].File
+			}
+			return objects[i].Generation < objects[j].Generation
+		})
+	}
+}
+
+// optionsFromRequest reads MIN_AGE_HOURS, INCLUDE_PREFIXES, EXCLUDE_PREFIXES,
+// CLEANUP_CONCURRENCY and SILENT_AFTER_DAYS from the environment and the dryRun
+// query parameter.
+func optionsFromRequest(r *http.Request) (cleanupOptions, error) {
+	options := cleanupOptions{
+		minAge:          defaultMinAgeHours * time.Hour,
+		includePrefixes: splitPrefixes(os.Getenv("INCLUDE_PREFIXES")),
+		excludePrefixes: splitPrefixes(os.Getenv("EXCLUDE_PREFIXES")),
+		concurrency:     defaultConcurrency,
+		silentAfter:     defaultSilentAfterDays * 24 * time.Hour,
+	}
+
+	if value := os.Getenv("MIN_AGE_HOURS"); value != "" {
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours < 0 {
+			return options, fmt.Errorf("MIN_AGE_HOURS must be a non-negative number of hours, got %q", value)
+		}
+		options.minAge = time.Duration(hours) * time.Hour
+	}
+
+	if value := os.Getenv("CLEANUP_CONCURRENCY"); value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency <= 0 {
+			return options, fmt.Errorf("CLEANUP_CONCURRENCY must be a positive number, got %q", value)
+		}
+		options.concurrency = concurrency
+	}
+
+	if value := os.Getenv("SILENT_AFTER_DAYS"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 0 {
+			return options, fmt.Errorf("SILENT_AFTER_DAYS must be a non-negative number of days, got %q", value)
+		}
+		options.silentAfter = time.Duration(days) * 24 * time.Hour
+	}
+
+	if value := r.URL.Query().Get("dryRun"); value != "" {
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("dryRun must be a boolean, got %q", value)
+		}
+		options.dryRun = dryRun
+	}
+	return options, nil
+}
+
+func splitPrefixes(value string) []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(value, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
 		}
+	}
+	return prefixes
+}
 
-		totalDeleted++
+// matchesPrefix tells whether the object is included and not excluded, exclusions win.
+func (o *cleanupOptions) matchesPrefix(fileName string) bool {
+	for _, prefix := range o.excludePrefixes {
+		if strings.HasPrefix(fileName, prefix) {
+			return false
+		}
 	}
+	if len(o.includePrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range o.includePrefixes {
+		if strings.HasPrefix(fileName, prefix) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Return success response
-	log.Printf("Successfully deleted %d documents and corresponding files.", totalDeleted)
-	fmt.Fprintf(w, "Successfully deleted %d documents and corresponding files.\n", totalDeleted)
+func (o *uploadedObject) reported(reason string) reportedObject {
+	return reportedObject{Bucket: o.bucketName, File: o.fileName, Generation: o.generation, Reason: reason}
+}
+
+// loadDevices returns the registration time of every device the cleanup waits
+// for. Retired devices and devices silent for longer than silentAfter would
+// hold every object back, they are left out.
+func loadDevices(ctx context.Context, collection *firestore.CollectionRef, now time.Time, silentAfter time.Duration) (map[string]time.Time, error) {
+	docs, err := collection.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string]time.Time, len(docs))
+	for _, doc := range docs {
+		var device registeredDevice
+		if err := doc.DataTo(&device); err != nil {
+			return nil, fmt.Errorf("error mapping device %s: %w", doc.Ref.ID, err)
+		}
+		if device.Retired {
+			log.Printf("Device %s is retired, not waiting for it", device.DeviceId)
+			continue
+		}
+		if silentAfter > 0 && device.silentFor(now) > silentAfter {
+			log.Printf("Device %s was not seen for %s, not waiting for it", device.DeviceId, device.silentFor(now).Truncate(time.Hour))
+			continue
+		}
+		devices[device.DeviceId] = device.RegisteredAt
+	}
+	return devices, nil
+}
+
+// silentFor tells how long the device did not send a heartbeat, devices that
+// never sent one count from their registration.
+func (d *registeredDevice) silentFor(now time.Time) time.Duration {
+	lastSeenAt := d.LastSeenAt
+	if lastSeenAt.IsZero() {
+		lastSeenAt = d.RegisteredAt
+	}
+	return now.Sub(lastSeenAt)
+}
+
+// missingDevices lists the devices registered before the upload that did not confirm it yet.
+func (o *uploadedObject) missingDevices(devices map[string]time.Time, uploadedAt time.Time) []string {
+	var missing []string
+	for deviceId, registeredAt := range devices {
+		if registeredAt.After(uploadedAt) {
+			continue
+		}
+		if _, confirmed := o.confirmedBy[deviceId]; !confirmed {
+			missing = append(missing, deviceId)
+		}
+	}
+	sort.Strings(missing)
+	return missing
 }
 
 // Helper function to delete a file from Cloud Storage
-func deleteFileFromStorage(ctx context.Context, client *storage.Client, bucketName, fileName string) error {
+func deleteFileFromStorage(ctx context.Context, client *storage.Client, bucketName, fileName string, generation int64) error {
 	bucket := client.Bucket(bucketName)
 	object := bucket.Object(fileName)
+	if generation != 0 {
+		// Never delete a newer upload that appeared in the meantime
+		object = object.If(storage.Conditions{GenerationMatch: generation})
+	}
 
-	// Deletes the file
+	// Deletes the file, an object that is already gone counts as deleted
 	err := object.Delete(ctx)
-	if err != nil {
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
 		return fmt.Errorf("failed to delete file from Cloud Storage: %w", err)
 	}
 
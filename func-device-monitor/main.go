@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"pushauth"
+)
+
+const (
+	defaultDevicesCollection  = "devices"
+	defaultSilentAfterMinutes = 30
+)
+
+type device struct {
+	DeviceId     string    `firestore:"deviceId"`
+	RegisteredAt time.Time `firestore:"registeredAt"`
+	Hostname     string    `firestore:"hostname"`
+	Version      string    `firestore:"version"`
+	Consoles     []string  `firestore:"consoles"`
+	FreeBytes    int64     `firestore:"freeBytes"`
+	LastSeenAt   time.Time `firestore:"lastSeenAt"`
+}
+
+type deviceStatus struct {
+	DeviceId      string    `json:"deviceId"`
+	Hostname      string    `json:"hostname"`
+	Version       string    `json:"version"`
+	Consoles      []string  `json:"consoles"`
+	FreeBytes     int64     `json:"freeBytes"`
+	RegisteredAt  time.Time `json:"registeredAt"`
+	LastSeenAt    time.Time `json:"lastSeenAt"`
+	SilentMinutes int       `json:"silentMinutes"`
+	Silent        bool      `json:"silent"`
+}
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	verifier, err := pushauth.NewVerifier(pushauth.ConfigFromEnv())
+	if err != nil {
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+	http.Handle("/", verifier.Middleware(http.HandlerFunc(DevicesHandler)))
+
+	log.Printf("Starting server on port %s...", port)
+	if err := http.ListenAndServe(":"+port, nil); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+// DevicesHandler lists the registered devices and flags the ones whose last
+// heartbeat is older than SILENT_AFTER_MINUTES.
+func DevicesHandler(w http.ResponseWriter, _ *http.Request) {
+	ctx := context.Background()
+
+	silentAfter, err := silentAfterFromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	collectionName := os.Getenv("DEVICES_COLLECTION")
+	if collectionName == "" {
+		collectionName = defaultDevicesCollection
+	}
+
+	// Initialize Firestore client
+	firestoreClient, err := firestore.NewClient(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create Firestore client: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Close()
+
+	docs, err := firestoreClient.Collection(collectionName).Documents(ctx).GetAll()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading Firestore documents: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	statuses := make([]deviceStatus, 0, len(docs))
+	silentCount := 0
+	for _, doc := range docs {
+		var data device
+		if err := doc.DataTo(&data); err != nil {
+			http.Error(w, fmt.Sprintf("Error mapping document data: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Devices that never sent a heartbeat count as silent since their registration
+		lastSeenAt := data.LastSeenAt
+		if lastSeenAt.IsZero() {
+			lastSeenAt = data.RegisteredAt
+		}
+
+		silentFor := now.Sub(lastSeenAt)
+		status := deviceStatus{
+			DeviceId:      data.DeviceId,
+			Hostname:      data.Hostname,
+			Version:       data.Version,
+			Consoles:      data.Consoles,
+			FreeBytes:     data.FreeBytes,
+			RegisteredAt:  data.RegisteredAt,
+			LastSeenAt:    data.LastSeenAt,
+			SilentMinutes: int(silentFor.Minutes()),
+			Silent:        silentFor > silentAfter,
+		}
+		if status.Silent {
+			silentCount++
+		}
+		statuses = append(statuses, status)
+	}
+
+	// Silent devices first, the longest silent on top
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Silent != statuses[j].Silent {
+			return statuses[i].Silent
+		}
+		return statuses[i].SilentMinutes > statuses[j].SilentMinutes
+	})
+
+	log.Printf("Listed %d devices, %d of them silent for more than %s.", len(statuses), silentCount, silentAfter)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func silentAfterFromEnv() (time.Duration, error) {
+	value := os.Getenv("SILENT_AFTER_MINUTES")
+	if value == "" {
+		return defaultSilentAfterMinutes * time.Minute, nil
+	}
+
+	minutes, err := strconv.Atoi(value)
+	if err != nil || minutes <= 0 {
+		return 0, fmt.Errorf("SILENT_AFTER_MINUTES must be a positive number of minutes, got %q", value)
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
@@ -8,23 +8,72 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"pushauth"
 )
 
+// PushRequest is the envelope Pub/Sub wraps every pushed message in.
+type PushRequest struct {
+	Message         PubSubMessage `json:"message"`
+	Subscription    string        `json:"subscription"`
+	DeliveryAttempt int           `json:"deliveryAttempt"` // Only set when the subscription has a dead letter policy
+}
+
 type PubSubMessage struct {
-	Data []byte `json:"data"`
+	Data        []byte            `json:"data"` // Base64 in the request, decoded by encoding/json
+	Attributes  map[string]string `json:"attributes"`
+	MessageId   string            `json:"messageId"`
+	PublishTime time.Time         `json:"publishTime"`
+}
+
+// RomUploadedMessage is the payload the upload notifications carry.
+type RomUploadedMessage struct {
+	Bucket  string    `json:"bucket"`
+	File    string    `json:"file"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
 }
 
 type FirestoreEntry struct {
-	Message   string    `json:"message"`
-	Timestamp time.Time `json:"timestamp"`
+	MessageId          string            `firestore:"messageId" json:"messageId"`
+	Bucket             string            `firestore:"bucket" json:"bucket"`
+	File               string            `firestore:"file" json:"file"`
+	Created            time.Time         `firestore:"created" json:"created"`
+	Updated            time.Time         `firestore:"updated" json:"updated"`
+	DeliveryAttempt    int               `firestore:"deliveryAttempt" json:"deliveryAttempt"`
+	Attributes         map[string]string `firestore:"attributes" json:"attributes"`
+	Subscription       string            `firestore:"subscription" json:"subscription"`
+	SourceSubscription string            `firestore:"sourceSubscription" json:"sourceSubscription"`
+	PublishTime        time.Time         `firestore:"publishTime" json:"publishTime"`
+	Data               []byte            `firestore:"data" json:"-"`          // Original payload, republished on replay
+	RawData            string            `firestore:"rawData" json:"rawData"` // Only set when the payload is not a RomUploadedMessage
+	Timestamp          time.Time         `firestore:"timestamp" json:"timestamp"`
+	ReplayedAt         *time.Time        `firestore:"replayedAt" json:"replayedAt"`
+	ReplayCount        int               `firestore:"replayCount" json:"replayCount"`
 }
 
+// Attributes Pub/Sub adds to messages forwarded to a dead letter topic
+const (
+	deadLetterDeliveryCountAttribute = "CloudPubSubDeadLetterSourceDeliveryCount"
+	deadLetterSubscriptionAttribute  = "CloudPubSubDeadLetterSourceSubscription"
+)
+
 func main() {
-	// Set up the HTTP server.
-	http.HandleFunc("/", HandlePubSubPush)
+	verifier, err := pushauth.NewVerifier(pushauth.ConfigFromEnv())
+	if err != nil {
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+
+	// Set up the HTTP server, every route requires a Google signed token.
+	// Pushes only match the root, other paths must not be parsed as messages.
+	http.Handle("POST /{$}", verifier.Middleware(http.HandlerFunc(HandlePubSubPush)))
+	http.Handle("GET /entries", verifier.Middleware(http.HandlerFunc(HandleListEntries)))
+	http.Handle("POST /replay", verifier.Middleware(http.HandlerFunc(HandleReplay)))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -51,27 +100,26 @@ func HandlePubSubPush(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	// Parse the Pub/Sub message from the request body.
-	var pubSubMessage PubSubMessage
-	if err := json.Unmarshal(body, &pubSubMessage); err != nil {
+	// Parse the push envelope from the request body.
+	var pushRequest PushRequest
+	if err := json.Unmarshal(body, &pushRequest); err != nil {
 		http.Error(w, "Invalid Pub/Sub message format", http.StatusBadRequest)
-		log.Printf("Error unmarshaling Pub/Sub message: %v", err)
+		log.Printf("Error unmarshaling Pub/Sub push request: %v", err)
 		return
 	}
 
-	// Decode the "Data" field which contains the actual message.
-	var message string
-	if err := json.Unmarshal(pubSubMessage.Data, &message); err != nil {
-		http.Error(w, "Invalid message data format", http.StatusBadRequest)
-		log.Printf("Error unmarshaling message data: %v", err)
+	if pushRequest.Message.MessageId == "" {
+		http.Error(w, "Missing Pub/Sub message ID", http.StatusBadRequest)
+		log.Printf("Pub/Sub push request has no message ID")
 		return
 	}
 
-	log.Printf("Received message: %s", message)
+	entry := newFirestoreEntry(&pushRequest)
+	log.Printf("Received dead letter %s for file %s/%s after %d delivery attempts", entry.MessageId, entry.Bucket, entry.File, entry.DeliveryAttempt)
 
 	// Process the message using Firestore.
 	ctx := context.Background()
-	if err := writeToFirestore(ctx, message); err != nil {
+	if err := writeToFirestore(ctx, entry); err != nil {
 		http.Error(w, "Failed to process message", http.StatusInternalServerError)
 		log.Printf("Error writing to Firestore: %v", err)
 		return
@@ -82,8 +130,43 @@ func HandlePubSubPush(w http.ResponseWriter, r *http.Request) {
 	log.Println("Message successfully processed")
 }
 
-// writeToFirestore writes the message data to Firestore.
-func writeToFirestore(ctx context.Context, message string) error {
+// newFirestoreEntry decodes the RomUploadedMessage payload. Payloads that are
+// not one are kept as raw data, a dead letter must never get lost.
+func newFirestoreEntry(pushRequest *PushRequest) *FirestoreEntry {
+	message := pushRequest.Message
+	entry := &FirestoreEntry{
+		MessageId:          message.MessageId,
+		DeliveryAttempt:    pushRequest.DeliveryAttempt,
+		Attributes:         message.Attributes,
+		Subscription:       pushRequest.Subscription,
+		SourceSubscription: message.Attributes[deadLetterSubscriptionAttribute],
+		PublishTime:        message.PublishTime,
+		Data:               message.Data,
+		Timestamp:          time.Now(),
+	}
+
+	// Attempts made on the source subscription before the message was dead lettered
+	if deliveryCount, err := strconv.Atoi(message.Attributes[deadLetterDeliveryCountAttribute]); err == nil {
+		entry.DeliveryAttempt = deliveryCount
+	}
+
+	var payload RomUploadedMessage
+	if err := json.Unmarshal(message.Data, &payload); err != nil {
+		log.Printf("Error unmarshaling message data of %s, storing it raw: %v", message.MessageId, err)
+		entry.RawData = string(message.Data)
+		return entry
+	}
+
+	entry.Bucket = payload.Bucket
+	entry.File = payload.File
+	entry.Created = payload.Created
+	entry.Updated = payload.Updated
+	return entry
+}
+
+// writeToFirestore writes the dead letter to Firestore, keyed by its message ID
+// so a redelivered push does not store it twice or reset its replay history.
+func writeToFirestore(ctx context.Context, entry *FirestoreEntry) error {
 	// Retrieve Firestore project and collection configuration from environment variables.
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	if projectID == "" {
@@ -101,14 +184,12 @@ func writeToFirestore(ctx context.Context, message string) error {
 	}
 	defer client.Close()
 
-	// Create a Firestore entry.
-	entry := FirestoreEntry{
-		Message:   message,
-		Timestamp: time.Now(),
+	// Write the entry to Firestore, an existing entry is kept as it is.
+	_, err = client.Collection(collectionName).Doc(entry.MessageId).Create(ctx, entry)
+	if status.Code(err) == codes.AlreadyExists {
+		log.Printf("Entry for message %s already exists", entry.MessageId)
+		return nil
 	}
-
-	// Write the entry to Firestore.
-	_, _, err = client.Collection(collectionName).Add(ctx, entry)
 	if err != nil {
 		return fmt.Errorf("failed to write to Firestore: %w", err)
 	}
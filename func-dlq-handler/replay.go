@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/pubsub"
+)
+
+const deadLetterAttributePrefix = "CloudPubSubDeadLetter"
+
+// EntryFilter selects DLQ entries, zero values match everything.
+type EntryFilter struct {
+	Bucket     string
+	FilePrefix string
+	Since      time.Time // Entries stored at or after
+	Until      time.Time // Entries stored before
+}
+
+// ReplayRequest names the entries to republish, All replays every entry matching
+// the filter that was not replayed yet. IncludeReplayed makes All replay those too.
+type ReplayRequest struct {
+	MessageIds      []string `json:"messageIds"`
+	All             bool     `json:"all"`
+	IncludeReplayed bool     `json:"includeReplayed"`
+}
+
+type ReplayResponse struct {
+	Replayed []string          `json:"replayed"`
+	Failed   map[string]string `json:"failed"`
+}
+
+type storedEntry struct {
+	ref   *firestore.DocumentRef
+	entry FirestoreEntry
+}
+
+// HandleListEntries returns the DLQ entries matching the bucket, prefix, since and until query parameters.
+func HandleListEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	filter, err := filterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, collection, err := openCollection(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error opening Firestore collection: %v", err)
+		return
+	}
+	defer client.Close()
+
+	stored, err := listEntries(ctx, collection, filter)
+	if err != nil {
+		http.Error(w, "Failed to list entries", http.StatusInternalServerError)
+		log.Printf("Error listing entries: %v", err)
+		return
+	}
+
+	entries := make([]FirestoreEntry, 0, len(stored))
+	for _, storedEntry := range stored {
+		entries = append(entries, storedEntry.entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// HandleReplay republishes the selected entries to the upload topic with their
+// original attributes and marks them as replayed.
+func HandleReplay(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	filter, err := filterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var replayRequest ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&replayRequest); err != nil {
+		http.Error(w, "Invalid replay request", http.StatusBadRequest)
+		log.Printf("Error unmarshaling replay request: %v", err)
+		return
+	}
+	if !replayRequest.All && len(replayRequest.MessageIds) == 0 {
+		http.Error(w, "Either messageIds or all has to be set", http.StatusBadRequest)
+		return
+	}
+
+	topicName := os.Getenv("UPLOAD_TOPIC")
+	if topicName == "" {
+		http.Error(w, "UPLOAD_TOPIC environment variable is not set", http.StatusInternalServerError)
+		return
+	}
+
+	client, collection, err := openCollection(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error opening Firestore collection: %v", err)
+		return
+	}
+	defer client.Close()
+
+	stored, err := listEntries(ctx, collection, filter)
+	if err != nil {
+		http.Error(w, "Failed to list entries", http.StatusInternalServerError)
+		log.Printf("Error listing entries: %v", err)
+		return
+	}
+
+	pubsubClient, err := pubsub.NewClient(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"))
+	if err != nil {
+		http.Error(w, "Failed to create Pub/Sub client", http.StatusInternalServerError)
+		log.Printf("Error creating Pub/Sub client: %v", err)
+		return
+	}
+	defer pubsubClient.Close()
+
+	topic := pubsubClient.Topic(topicName)
+	defer topic.Stop()
+
+	selected := selectEntries(stored, &replayRequest)
+	response := ReplayResponse{Replayed: []string{}, Failed: make(map[string]string)}
+	for _, messageId := range replayRequest.MessageIds {
+		if _, found := selected[messageId]; !found {
+			response.Failed[messageId] = "entry not found"
+		}
+	}
+
+	for messageId, storedEntry := range selected {
+		if err := replayEntry(ctx, topic, storedEntry); err != nil {
+			response.Failed[messageId] = err.Error()
+			log.Printf("Error replaying entry %s: %v", messageId, err)
+			continue
+		}
+		response.Replayed = append(response.Replayed, messageId)
+	}
+
+	log.Printf("Replayed %d entries, %d failed", len(response.Replayed), len(response.Failed))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func replayEntry(ctx context.Context, topic *pubsub.Topic, storedEntry *storedEntry) error {
+	data, err := replayPayload(&storedEntry.entry)
+	if err != nil {
+		return err
+	}
+
+	result := topic.Publish(ctx, &pubsub.Message{
+		Data:       data,
+		Attributes: originalAttributes(storedEntry.entry.Attributes),
+	})
+	if _, err := result.Get(ctx); err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+
+	_, err = storedEntry.ref.Update(ctx, []firestore.Update{
+		{Path: "replayedAt", Value: time.Now()},
+		{Path: "replayCount", Value: firestore.Increment(1)},
+	})
+	if err != nil {
+		return fmt.Errorf("published, but failed to mark as replayed: %w", err)
+	}
+	return nil
+}
+
+// replayPayload returns the original payload, entries stored before it was
+// kept get it rebuilt from their structured fields.
+func replayPayload(entry *FirestoreEntry) ([]byte, error) {
+	if len(entry.Data) > 0 {
+		return entry.Data, nil
+	}
+	if entry.Bucket == "" || entry.File == "" {
+		return nil, fmt.Errorf("entry has no payload to replay")
+	}
+
+	return json.Marshal(RomUploadedMessage{
+		Bucket:  entry.Bucket,
+		File:    entry.File,
+		Created: entry.Created,
+		Updated: entry.Updated,
+	})
+}
+
+// originalAttributes drops the attributes Pub/Sub added when dead lettering the message.
+func originalAttributes(attributes map[string]string) map[string]string {
+	original := make(map[string]string, len(attributes))
+	for key, value := range attributes {
+		if !strings.HasPrefix(key, deadLetterAttributePrefix) {
+			original[key] = value
+		}
+	}
+	return original
+}
+
+func selectEntries(stored []storedEntry, replayRequest *ReplayRequest) map[string]*storedEntry {
+	wanted := make(map[string]struct{}, len(replayRequest.MessageIds))
+	for _, messageId := range replayRequest.MessageIds {
+		wanted[messageId] = struct{}{}
+	}
+
+	selected := make(map[string]*storedEntry)
+	for i := range stored {
+		messageId := stored[i].entry.MessageId
+		if _, isWanted := wanted[messageId]; isWanted {
+			selected[messageId] = &stored[i]
+			continue
+		}
+
+		// Replayed uploads were most likely recovered, replaying all must not repeat them
+		if replayRequest.All && (stored[i].entry.ReplayCount == 0 || replayRequest.IncludeReplayed) {
+			selected[messageId] = &stored[i]
+		}
+	}
+	return selected
+}
+
+// listEntries reads the entries matching the filter, oldest first. The bucket
+// is filtered by Firestore, the rest in memory to avoid composite indexes.
+func listEntries(ctx context.Context, collection *firestore.CollectionRef, filter EntryFilter) ([]storedEntry, error) {
+	query := collection.Query
+	if filter.Bucket != "" {
+		query = query.Where("bucket", "==", filter.Bucket)
+	}
+
+	docs, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []storedEntry
+	for _, doc := range docs {
+		var entry FirestoreEntry
+		if err := doc.DataTo(&entry); err != nil {
+			return nil, fmt.Errorf("error mapping document %s: %w", doc.Ref.ID, err)
+		}
+		if filter.matches(&entry) {
+			entries = append(entries, storedEntry{ref: doc.Ref, entry: entry})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].entry.Timestamp.Before(entries[j].entry.Timestamp)
+	})
+	return entries, nil
+}
+
+func (f EntryFilter) matches(entry *FirestoreEntry) bool {
+	if f.FilePrefix != "" && !strings.HasPrefix(entry.File, f.FilePrefix) {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Timestamp.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+func filterFromQuery(values url.Values) (EntryFilter, error) {
+	filter := EntryFilter{
+		Bucket:     values.Get("bucket"),
+		FilePrefix: values.Get("prefix"),
+	}
+
+	var err error
+	if filter.Since, err = parseFilterTime(values.Get("since")); err != nil {
+		return filter, fmt.Errorf("invalid since: %w", err)
+	}
+	if filter.Until, err = parseFilterTime(values.Get("until")); err != nil {
+		return filter, fmt.Errorf("invalid until: %w", err)
+	}
+	return filter, nil
+}
+
+// parseFilterTime accepts RFC 3339 timestamps and plain dates.
+func parseFilterTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+func openCollection(ctx context.Context) (*firestore.Client, *firestore.CollectionRef, error) {
+	collectionName := os.Getenv("FIRESTORE_COLLECTION")
+	if collectionName == "" {
+		return nil, nil, fmt.Errorf("environment variable FIRESTORE_COLLECTION is not set")
+	}
+
+	client, err := firestore.NewClient(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create Firestore client: %w", err)
+	}
+	return client, client.Collection(collectionName), nil
+}
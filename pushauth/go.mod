@@ -0,0 +1,3 @@
+module pushauth
+
+go 1.23.0
@@ -0,0 +1,144 @@
+package pushauth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeysMaxAge = time.Hour
+
+	// Unknown key IDs trigger a refresh, but not more often than this
+	minRefreshInterval = time.Minute
+)
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	KeyId     string `json:"kid"`
+	KeyType   string `json:"kty"`
+	Algorithm string `json:"alg"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// keySet caches the RSA keys published at the JWKS URL.
+type keySet struct {
+	url        string
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	expiresAt   time.Time
+	refreshedAt time.Time
+}
+
+func newKeySet(url string, httpClient *http.Client) *keySet {
+	return &keySet{url: url, httpClient: httpClient}
+}
+
+// key returns the key with the ID, fetching the set again when it expired or
+// the key is unknown, Google rotates its keys regularly.
+func (s *keySet) key(keyId string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	key, known := s.keys[keyId]
+	if known && now.Before(s.expiresAt) {
+		return key, nil
+	}
+
+	if now.Sub(s.refreshedAt) < minRefreshInterval && now.Before(s.expiresAt) {
+		return nil, fmt.Errorf("unknown key id %s", keyId)
+	}
+
+	if err := s.refresh(now); err != nil {
+		return nil, err
+	}
+
+	key, known = s.keys[keyId]
+	if !known {
+		return nil, fmt.Errorf("unknown key id %s", keyId)
+	}
+	return key, nil
+}
+
+func (s *keySet) refresh(now time.Time) error {
+	s.refreshedAt = now
+
+	response, err := s.httpClient.Get(s.url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch keys from %s: %w", s.url, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch keys from %s: status %d", s.url, response.StatusCode)
+	}
+
+	var keySet jsonWebKeySet
+	if err := json.NewDecoder(response.Body).Decode(&keySet); err != nil {
+		return fmt.Errorf("failed to decode keys from %s: %w", s.url, err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return fmt.Errorf("invalid key %s: %w", jwk.KeyId, err)
+		}
+		keys[jwk.KeyId] = key
+	}
+
+	s.keys = keys
+	s.expiresAt = now.Add(maxAge(response.Header.Get("Cache-Control")))
+	return nil
+}
+
+func (k *jsonWebKey) publicKey() (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(k.Modulus)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode modulus: %w", err)
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(k.Exponent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode exponent: %w", err)
+	}
+
+	publicKey := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}
+	if publicKey.E < 3 || publicKey.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("key is too weak")
+	}
+	return publicKey, nil
+}
+
+// maxAge reads how long the keys may be cached from the Cache-Control header.
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(directive), "=")
+		if !found || name != "max-age" {
+			continue
+		}
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultKeysMaxAge
+}
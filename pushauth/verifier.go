@@ -0,0 +1,214 @@
+// Package pushauth verifies the OIDC tokens Pub/Sub push subscriptions and
+// Cloud Scheduler attach to their requests.
+package pushauth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	GoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+	// Tolerated clock difference between Google and the service
+	clockSkew = time.Minute
+)
+
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+var (
+	ErrMissingToken    = errors.New("missing bearer token")
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrEmailNotAllowed = errors.New("email is not allowed")
+)
+
+type Config struct {
+	JWKSURL       string   // Defaults to Google's keys
+	Issuers       []string // Defaults to Google's issuers
+	Audience      string   // Has to match the audience set on the push subscription or scheduler job
+	AllowedEmails []string // Service accounts allowed to call, at least one is required
+}
+
+// ConfigFromEnv reads AUTH_AUDIENCE, AUTH_ALLOWED_EMAILS (comma separated) and AUTH_JWKS_URL.
+func ConfigFromEnv() Config {
+	config := Config{
+		JWKSURL:  os.Getenv("AUTH_JWKS_URL"),
+		Audience: os.Getenv("AUTH_AUDIENCE"),
+	}
+	for _, email := range strings.Split(os.Getenv("AUTH_ALLOWED_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			config.AllowedEmails = append(config.AllowedEmails, email)
+		}
+	}
+	return config
+}
+
+// Claims are the parts of the token the services care about.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Audience      audience `json:"aud"`
+	Subject       string   `json:"sub"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	NotBefore     int64    `json:"nbf"`
+}
+
+// audience accepts both forms the aud claim can take, a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyId     string `json:"kid"`
+}
+
+type Verifier struct {
+	config Config
+	keys   *keySet
+}
+
+func NewVerifier(config Config) (*Verifier, error) {
+	if config.Audience == "" {
+		return nil, fmt.Errorf("audience is not configured")
+	}
+	// Any Google account can get a token for any audience, only the email tells callers apart
+	if len(config.AllowedEmails) == 0 {
+		return nil, fmt.Errorf("allowed emails are not configured")
+	}
+	if config.JWKSURL == "" {
+		config.JWKSURL = GoogleJWKSURL
+	}
+	if len(config.Issuers) == 0 {
+		config.Issuers = googleIssuers
+	}
+
+	return &Verifier{
+		config: config,
+		keys:   newKeySet(config.JWKSURL, &http.Client{Timeout: 10 * time.Second}),
+	}, nil
+}
+
+// Verify checks the signature and claims of the token and returns its claims.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: invalid header: %v", ErrInvalidToken, err)
+	}
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidToken, header.Algorithm)
+	}
+
+	key, err := v.keys.key(header.KeyId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature encoding", ErrInvalidToken)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("%w: invalid signature", ErrInvalidToken)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid claims: %v", ErrInvalidToken, err)
+	}
+	if err := v.checkClaims(&claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (v *Verifier) checkClaims(claims *Claims, now time.Time) error {
+	if !slices.Contains(v.config.Issuers, claims.Issuer) {
+		return fmt.Errorf("%w: unexpected issuer %s", ErrInvalidToken, claims.Issuer)
+	}
+	if !slices.Contains(claims.Audience, v.config.Audience) {
+		return fmt.Errorf("%w: unexpected audience %v", ErrInvalidToken, []string(claims.Audience))
+	}
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)) {
+		return fmt.Errorf("%w: token expired", ErrInvalidToken)
+	}
+	if claims.IssuedAt != 0 && now.Add(clockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return fmt.Errorf("%w: token issued in the future", ErrInvalidToken)
+	}
+	if claims.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return fmt.Errorf("%w: token not valid yet", ErrInvalidToken)
+	}
+
+	if !claims.EmailVerified || !slices.Contains(v.config.AllowedEmails, claims.Email) {
+		return fmt.Errorf("%w: %s", ErrEmailNotAllowed, claims.Email)
+	}
+	return nil
+}
+
+// Middleware lets only requests with a valid bearer token through.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			http.Error(w, ErrMissingToken.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := v.Verify(token)
+		if errors.Is(err, ErrEmailNotAllowed) {
+			log.Printf("Rejected request from %s: %v", r.RemoteAddr, err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Printf("Rejected request from %s: %v", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		log.Printf("Authenticated request from %s", claims.Email)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func decodeSegment(segment string, target any) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, target)
+}
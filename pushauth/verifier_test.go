@@ -0,0 +1,263 @@
+package pushauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testAudience = "https://cleaner.example.run.app"
+	testEmail    = "scheduler@project.iam.gserviceaccount.com"
+)
+
+// testKeys serves a JWKS backed by locally generated keys, keys can be rotated mid test.
+type testKeys struct {
+	t       *testing.T
+	server  *httptest.Server
+	fetches atomic.Int32
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T, keyIds ...string) *testKeys {
+	t.Helper()
+
+	keys := &testKeys{t: t, keys: make(map[string]*rsa.PrivateKey)}
+	for _, keyId := range keyIds {
+		keys.add(keyId)
+	}
+
+	keys.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		keys.fetches.Add(1)
+
+		keys.mu.Lock()
+		defer keys.mu.Unlock()
+
+		var keySet jsonWebKeySet
+		for keyId, key := range keys.keys {
+			keySet.Keys = append(keySet.Keys, jsonWebKey{
+				KeyId:     keyId,
+				KeyType:   "RSA",
+				Algorithm: "RS256",
+				Modulus:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(keySet)
+	}))
+	t.Cleanup(keys.server.Close)
+	return keys
+}
+
+func (k *testKeys) add(keyId string) *rsa.PrivateKey {
+	k.t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		k.t.Fatalf("failed to generate key: %v", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[keyId] = key
+	return key
+}
+
+func (k *testKeys) key(keyId string) *rsa.PrivateKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.keys[keyId]
+}
+
+func (k *testKeys) verifier() *Verifier {
+	k.t.Helper()
+
+	verifier, err := NewVerifier(Config{
+		JWKSURL:       k.server.URL,
+		Audience:      testAudience,
+		AllowedEmails: []string{testEmail},
+	})
+	if err != nil {
+		k.t.Fatalf("failed to create verifier: %v", err)
+	}
+	return verifier
+}
+
+func validClaims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            "https://accounts.google.com",
+		"aud":            testAudience,
+		"sub":            "1234567890",
+		"email":          testEmail,
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, header map[string]string, claims map[string]any) string {
+	t.Helper()
+
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("failed to encode header: %v", err)
+	}
+	encodedClaims, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to encode claims: %v", err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(encodedClaims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func rs256(keyId string) map[string]string {
+	return map[string]string{"alg": "RS256", "kid": keyId, "typ": "JWT"}
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t, "current")
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	withClaim := func(name string, value any) map[string]any {
+		claims := validClaims()
+		claims[name] = value
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid token", sign(t, keys.key("current"), rs256("current"), validClaims()), nil},
+		{"audience list", sign(t, keys.key("current"), rs256("current"), withClaim("aud", []string{"other", testAudience})), nil},
+		{"bad signature", sign(t, otherKey, rs256("current"), validClaims()), ErrInvalidToken},
+		{"wrong audience", sign(t, keys.key("current"), rs256("current"), withClaim("aud", "https://other.example.run.app")), ErrInvalidToken},
+		{"wrong issuer", sign(t, keys.key("current"), rs256("current"), withClaim("iss", "https://evil.example.com")), ErrInvalidToken},
+		{"expired", sign(t, keys.key("current"), rs256("current"), withClaim("exp", time.Now().Add(-time.Hour).Unix())), ErrInvalidToken},
+		{"not RS256", sign(t, keys.key("current"), map[string]string{"alg": "HS256", "kid": "current"}, validClaims()), ErrInvalidToken},
+		{"email not allowed", sign(t, keys.key("current"), rs256("current"), withClaim("email", "intruder@other.iam.gserviceaccount.com")), ErrEmailNotAllowed},
+		{"email not verified", sign(t, keys.key("current"), rs256("current"), withClaim("email_verified", false)), ErrEmailNotAllowed},
+		{"malformed", "not.a-token", ErrInvalidToken},
+	}
+
+	verifier := keys.verifier()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := verifier.Verify(test.token)
+			if test.wantErr == nil {
+				if err != nil {
+					t.Fatalf("expected valid token, got %v", err)
+				}
+				if claims.Email != testEmail {
+					t.Errorf("expected email %s, got %s", testEmail, claims.Email)
+				}
+				return
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("expected %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestVerifyRefreshesKeysForUnknownKeyId(t *testing.T) {
+	keys := newTestKeys(t, "old")
+	verifier := keys.verifier()
+
+	if _, err := verifier.Verify(sign(t, keys.key("old"), rs256("old"), validClaims())); err != nil {
+		t.Fatalf("expected valid token, got %v", err)
+	}
+
+	// Google rotated its keys, pretend the last fetch is long enough ago to refresh
+	rotated := keys.add("new")
+	verifier.keys.refreshedAt = time.Now().Add(-2 * minRefreshInterval)
+
+	if _, err := verifier.Verify(sign(t, rotated, rs256("new"), validClaims())); err != nil {
+		t.Fatalf("expected token signed with the rotated key to be valid, got %v", err)
+	}
+	if fetches := keys.fetches.Load(); fetches != 2 {
+		t.Errorf("expected 2 key fetches, got %d", fetches)
+	}
+
+	// Tokens with made up key IDs must not make every request fetch the keys
+	for range 3 {
+		if _, err := verifier.Verify(sign(t, rotated, rs256("made-up"), validClaims())); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("expected %v, got %v", ErrInvalidToken, err)
+		}
+	}
+	if fetches := keys.fetches.Load(); fetches != 2 {
+		t.Errorf("expected unknown key IDs to be rate limited, got %d key fetches", fetches)
+	}
+}
+
+func TestNewVerifierRequiresAllowedEmails(t *testing.T) {
+	if _, err := NewVerifier(Config{Audience: testAudience}); err == nil {
+		t.Fatal("expected an error without allowed emails")
+	}
+	if _, err := NewVerifier(Config{AllowedEmails: []string{testEmail}}); err == nil {
+		t.Fatal("expected an error without audience")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	keys := newTestKeys(t, "current")
+	handler := keys.verifier().Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	withEmail := validClaims()
+	withEmail["email"] = "intruder@other.iam.gserviceaccount.com"
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"valid token", "Bearer " + sign(t, keys.key("current"), rs256("current"), validClaims()), http.StatusNoContent},
+		{"missing token", "", http.StatusUnauthorized},
+		{"not a bearer token", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"invalid token", "Bearer not.a.token", http.StatusUnauthorized},
+		{"email not allowed", "Bearer " + sign(t, keys.key("current"), rs256("current"), withEmail), http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.wantStatus {
+				t.Errorf("expected status %d, got %d", test.wantStatus, recorder.Code)
+			}
+		})
+	}
+}